@@ -1,8 +1,6 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"math/rand"
@@ -10,8 +8,10 @@ import (
 	"net/url"
 	"regexp"
 	"text/template"
+	"time"
 
 	"github.com/kr/pretty"
+	"github.com/xeipuuv/gojsonschema"
 )
 
 /*
@@ -28,41 +28,43 @@ type Action struct {
 	URLTemplate *template.Template
 	Tag         *template.Template
 	Method      string
-	URLQuery    *template.Template
-	Headers     *template.Template
-	Content     *template.Template
+	URLQuery    *valuesTemplate
+	Headers     *valuesTemplate
+	Content     *ContentTemplate
 	ExpStatuses []int
 	MaxNrForks  int
 	RespTemps   []*template.Template
 	MustMatch   bool
-	rr          ResponseReader
+	When        *condition
+	ThinkTime   *thinkTime
+	// Maps variable names to the names of the response headers whose
+	// values should be stored in them.
+	HeaderCaptures map[string]string
+	// The variable in which the status code should be stored, if any.
+	StatusCapture string
+	// Extract variables from json responses.
+	JSONExtractors []*jsonExtractor
+	// Extract variables from HTML or XML responses.
+	NodeExtractors []*nodeExtractor
+	Assertions     []*assertion
+	// The tag before it is executed.
+	TagText string
+	// The JSON schema which the response should follow, if any.
+	Schema     *gojsonschema.Schema
+	SchemaFile string
+	rr         ResponseReader
 }
 
 func (self *Action) getURL(vars *Env) (url string, err error) {
-	var out bytes.Buffer
 	if self.URLTemplate == nil {
 		err = fmt.Errorf("No URL template")
 		return
 	}
-	err = self.URLTemplate.Execute(&out, vars.NameValuePairs)
-	if err != nil {
-		return
-	}
-	url = out.String()
-	return
+	return executeTemplate(self.URLTemplate, vars)
 }
 
 func (self *Action) getParams(vars *Env) (params url.Values, err error) {
-	var out bytes.Buffer
-	if self.URLQuery == nil {
-		return
-	}
-	err = self.URLQuery.Execute(&out, vars.NameValuePairs)
-	if err != nil {
-		return
-	}
-	ret := make(map[string][]string, 10)
-	err = json.Unmarshal(out.Bytes(), &ret)
+	ret, err := self.URLQuery.execute(vars)
 	if err != nil {
 		return
 	}
@@ -73,16 +75,7 @@ func (self *Action) getParams(vars *Env) (params url.Values, err error) {
 }
 
 func (self *Action) getHeaders(vars *Env) (headers http.Header, err error) {
-	var out bytes.Buffer
-	if self.Headers == nil {
-		return
-	}
-	err = self.Headers.Execute(&out, vars.NameValuePairs)
-	if err != nil {
-		return
-	}
-	ret := make(map[string][]string, 10)
-	err = json.Unmarshal(out.Bytes(), &ret)
+	ret, err := self.Headers.execute(vars)
 	if err != nil {
 		return
 	}
@@ -93,16 +86,10 @@ func (self *Action) getHeaders(vars *Env) (headers http.Header, err error) {
 }
 
 func (self *Action) getTag(vars *Env) (tag string, err error) {
-	var out bytes.Buffer
 	if self.Tag == nil {
 		return
 	}
-	err = self.Tag.Execute(&out, vars.NameValuePairs)
-	if err != nil {
-		return
-	}
-	tag = out.String()
-	return
+	return executeTemplate(self.Tag, vars)
 }
 
 func (self *Action) getContent(vars *Env) (content *HttpRequestContent, err error) {
@@ -114,19 +101,66 @@ func (self *Action) getRespPattern(vars *Env, idx int) (resp *regexp.Regexp, err
 		resp = nil
 		return
 	}
-	tmpl := self.RespTemps[idx]
-	var out bytes.Buffer
-	// FIXME This is dangours! Need to escape first
-	err = tmpl.Execute(&out, vars.NameValuePairs)
+	// The variables are quoted unless the action is raw.
+	pattern, err := executeTemplate(self.RespTemps[idx], vars)
 	if err != nil {
 		return
 	}
-	pattern := out.String()
 	resp, err = regexp.Compile(pattern)
 	return
 }
 
+// getCaptures returns the variables taken from the status and the headers
+// of the response, merged with the updates from the plugins. Headers
+// missing from the response are not captured.
+func (self *Action) getCaptures(resp *Response, rupdates *Env) *Env {
+	ret := EmptyEnv()
+	ret.Update(rupdates)
+	if resp == nil {
+		return ret
+	}
+	if len(self.StatusCapture) > 0 {
+		ret.NameValuePairs[self.StatusCapture] = fmt.Sprintf("%v", resp.Status)
+	}
+	for name, header := range self.HeaderCaptures {
+		if vs, ok := resp.Header[http.CanonicalHeaderKey(header)]; ok && len(vs) > 0 {
+			ret.NameValuePairs[name] = vs[0]
+		}
+	}
+	return ret
+}
+
+// checkAssertions returns an error describing all failed assertions, or
+// nil if all of them hold. The failure is also told to the plugins.
+func (self *Action) checkAssertions(req *Request, in *assertionInput) *AssertionError {
+	var failures []string
+	for _, a := range self.Assertions {
+		if f := a.check(in); len(f) > 0 {
+			failures = append(failures, f)
+		}
+	}
+	if len(failures) == 0 {
+		return nil
+	}
+	err := &AssertionError{
+		Tag:      req.Tag,
+		URL:      req.FullURL(),
+		Env:      in.vars,
+		Failures: failures,
+	}
+	if r, ok := self.rr.(AssertionFailureRecorder); ok {
+		r.RecordAssertionFailure(req, err)
+	}
+	return err
+}
+
 func (self *Action) Perform(vars *Env) (updates []*Env, err error) {
+	return self.perform(vars, nil, time.Time{})
+}
+
+// perform is like Perform, but attaches information about the iteration to
+// the request. scheduled is when the request was supposed to be sent.
+func (self *Action) perform(vars *Env, it *iteration, scheduled time.Time) (updates []*Env, err error) {
 	if self.Debug {
 		fmt.Printf("\n[DEBUG MESSAGE BEGIN]\n\n")
 		defer fmt.Printf("\n[DEBUG MESSAGE END]\n")
@@ -172,11 +206,24 @@ func (self *Action) Perform(vars *Env) (updates []*Env, err error) {
 		URLQuery: params,
 		Headers:  headers,
 	}
+	req.TagTemplate = self.TagText
+	req.Scheduled = scheduled
+	if it != nil {
+		req.Stage = it.stage
+		if it.scenario != nil {
+			req.Scenario = it.scenario.name
+		}
+	}
 
 	if self.Debug {
 		pretty.Printf("Req:\n%# v\nNeed to match %v patterns\n", req, len(self.RespTemps))
 	}
+	start := time.Now()
 	resp, rupdates, err := self.rr.ReadResponse(req, vars)
+	if resp != nil && resp.Body != nil {
+		// Always close the body, so that the connection can be reused.
+		defer resp.Body.Close()
+	}
 	if err != nil {
 		return
 	}
@@ -201,17 +248,47 @@ func (self *Action) Perform(vars *Env) (updates []*Env, err error) {
 		}
 	}
 
-	var u []*Env
-	hasMatched := false
-	if resp != nil && resp.Body != nil && len(self.RespTemps) > 0 {
-		body := resp.Body
-		defer body.Close()
-		var d []byte
-		d, err = ioutil.ReadAll(body)
+	hasBody := resp != nil && resp.Body != nil
+	hasExtractors := len(self.RespTemps) > 0 || len(self.JSONExtractors) > 0 || len(self.NodeExtractors) > 0
+	var d []byte
+	if hasBody && (hasExtractors || len(self.Assertions) > 0 || self.Schema != nil) {
+		d, err = ioutil.ReadAll(resp.Body)
 		if err != nil {
 			err = fmt.Errorf("URL %v: read body error. %v", url, err)
 			return
 		}
+	}
+	if len(self.Assertions) > 0 {
+		in := &assertionInput{
+			vars:    vars,
+			resp:    resp,
+			body:    d,
+			latency: time.Since(start),
+		}
+		if aerr := self.checkAssertions(req, in); aerr != nil {
+			err = aerr
+			return
+		}
+	}
+	if self.Schema != nil {
+		if violations := validateBody(self.Schema, d); len(violations) > 0 {
+			err = &SchemaError{
+				Tag:        req.Tag,
+				URL:        req.FullURL(),
+				Env:        vars,
+				Schema:     self.SchemaFile,
+				Violations: violations,
+			}
+			return
+		}
+	}
+
+	captures := self.getCaptures(resp, rupdates)
+	var u []*Env
+	hasMatched := false
+	hasMatchedJSON := false
+	hasMatchedNodes := false
+	if hasBody && hasExtractors {
 		data := string(d)
 		if self.Debug {
 			fmt.Printf("\tResp: %v\n", data)
@@ -257,29 +334,139 @@ func (self *Action) Perform(vars *Env) (updates []*Env, err error) {
 					e.NameValuePairs[v] = m[i]
 				}
 				if len(e.NameValuePairs) > 0 {
-					e.Update(rupdates)
+					e.Update(captures)
 					u = append(u, e)
 				}
 			}
 			// Only match at most one pattern
 			break
 		}
+		if len(self.JSONExtractors) > 0 {
+			var j []*Env
+			j, err = extractJSON(self.JSONExtractors, d)
+			if err != nil {
+				if self.MustMatch {
+					err = fmt.Errorf("URL %v: %v", url, err)
+					return
+				}
+				err = nil
+			}
+			if self.Debug {
+				fmt.Printf("\tExtracted from json: %+v\n", j)
+			}
+			hasMatchedJSON = len(j) > 0
+			u = joinForks(u, limitForks(j, self.MaxNrForks), captures)
+			u = limitForks(u, self.MaxNrForks)
+		}
+		if len(self.NodeExtractors) > 0 {
+			var n []*Env
+			n, err = extractNodes(self.NodeExtractors, d)
+			if err != nil {
+				if self.MustMatch {
+					err = fmt.Errorf("URL %v: %v", url, err)
+					return
+				}
+				err = nil
+			}
+			if self.Debug {
+				fmt.Printf("\tExtracted from nodes: %+v\n", n)
+			}
+			hasMatchedNodes = len(n) > 0
+			u = joinForks(u, limitForks(n, self.MaxNrForks), captures)
+			u = limitForks(u, self.MaxNrForks)
+		}
 	}
 
 	if len(self.RespTemps) > 0 && !hasMatched && self.MustMatch {
 		err = fmt.Errorf("URL %v: cannot find matched patterns in the response", url)
 		return
 	}
-	if len(self.RespTemps) == 0 {
+	if len(self.JSONExtractors) > 0 && !hasMatchedJSON && self.MustMatch {
+		err = fmt.Errorf("URL %v: cannot find matched JSONPath in the response", url)
 		return
 	}
-
+	if len(self.NodeExtractors) > 0 && !hasMatchedNodes && self.MustMatch {
+		err = fmt.Errorf("URL %v: cannot find matched nodes in the response", url)
+		return
+	}
+	// Plugins and captures only give variables which are asked for, so an
+	// action without any of them still returns no update.
 	if len(u) == 0 {
-		if !rupdates.IsEmpty() {
-			u = append(u, rupdates)
+		if !captures.IsEmpty() {
+			u = append(u, captures)
 		}
 	}
 
 	updates = u
 	return
 }
+
+// zipValues creates one environment per fork from the values extracted
+// from a response. Lists of values from different variables are zipped by
+// their indices, so the number of forks is the length of the shortest
+// list. A single value goes into every fork. No environment is returned if
+// there is no value at all.
+func zipValues(values map[string][]string, scalars map[string]string) (envs []*Env) {
+	nrForks := -1
+	for _, vs := range values {
+		if nrForks < 0 || len(vs) < nrForks {
+			nrForks = len(vs)
+		}
+	}
+	if nrForks < 0 {
+		if len(scalars) == 0 {
+			return
+		}
+		nrForks = 1
+	}
+	envs = make([]*Env, 0, nrForks)
+	for i := 0; i < nrForks; i++ {
+		env := EmptyEnv()
+		for name, v := range scalars {
+			env.NameValuePairs[name] = v
+		}
+		for name, vs := range values {
+			env.NameValuePairs[name] = vs[i]
+		}
+		envs = append(envs, env)
+	}
+	return
+}
+
+// limitForks randomly picks at most n of the environments. n <= 0 means no
+// limit.
+func limitForks(envs []*Env, n int) []*Env {
+	if n <= 0 || len(envs) <= n {
+		return envs
+	}
+	ret := make([]*Env, n)
+	for i, idx := range rand.Perm(len(envs))[:n] {
+		ret[i] = envs[idx]
+	}
+	return ret
+}
+
+// joinForks combines the forks found so far with the forks found by another
+// kind of extractor. Each of the existing forks, which already contain the
+// captures, is combined with each new fork. If there is no existing fork,
+// the new forks are used alone and captures are added to them.
+func joinForks(forks, newForks []*Env, captures *Env) []*Env {
+	if len(newForks) == 0 {
+		return forks
+	}
+	if len(forks) == 0 {
+		for _, e := range newForks {
+			e.Update(captures)
+		}
+		return newForks
+	}
+	ret := make([]*Env, 0, len(forks)*len(newForks))
+	for _, f := range forks {
+		for _, j := range newForks {
+			e := f.Clone()
+			e.Update(j)
+			ret = append(ret, e)
+		}
+	}
+	return ret
+}
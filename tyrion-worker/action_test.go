@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"testing"
 
@@ -24,6 +25,38 @@ func (self *responseReaderMock) Close() error {
 	return nil
 }
 
+// performAction performs the action with rr in env. The URL, the method
+// and the tag of the action are filled in if they are empty.
+func performAction(t *testing.T, as *ActionSpec, rr ResponseReader, env *Env) (updates []*Env, err error) {
+	if len(as.URLTemplate) == 0 {
+		as.URLTemplate = "http://localhost:8080/"
+	}
+	if len(as.Method) == 0 {
+		as.Method = "GET"
+	}
+	if len(as.Tag) == 0 {
+		as.Tag = "sometag"
+	}
+	action, err := as.GetAction(rr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return action.Perform(env)
+}
+
+// performActionOnBody performs the action against a response with the
+// body.
+func performActionOnBody(t *testing.T, as *ActionSpec, body string) (updates []*Env, err error) {
+	env := EmptyEnv()
+	rr := new(responseReaderMock)
+	resp := &Response{
+		Status: 200,
+		Body:   ioutil.NopCloser(bytes.NewBufferString(body)),
+	}
+	rr.On("ReadResponse", mock.Anything, env).Return(resp, &Env{}, nil)
+	return performAction(t, as, rr, env)
+}
+
 func envHasValues(env *Env, vals map[string]string) error {
 	for k, v := range vals {
 		if value, ok := env.NameValuePairs[k]; ok {
@@ -104,6 +137,7 @@ func TestPerformActionNoMatch(t *testing.T) {
 		URLQuery: v,
 		Headers:  h,
 	}
+	req.TagTemplate = as.Tag
 	resp := &Response{
 		Status: 200,
 		Body:   ioutil.NopCloser(bytes.NewBufferString(response)),
@@ -168,6 +202,7 @@ func TestPerformAction(t *testing.T) {
 		URLQuery: v,
 		Headers:  h,
 	}
+	req.TagTemplate = as.Tag
 	resp := &Response{
 		Status: 200,
 		Body:   ioutil.NopCloser(bytes.NewBufferString(response)),
@@ -242,6 +277,7 @@ func TestPerformActionWithForks(t *testing.T) {
 		URLQuery: v,
 		Headers:  h,
 	}
+	req.TagTemplate = as.Tag
 	resp := &Response{
 		Status: 200,
 		Body:   ioutil.NopCloser(bytes.NewBufferString(response)),
@@ -267,3 +303,135 @@ func TestPerformActionWithForks(t *testing.T) {
 		t.Errorf("updates: %+v, %+v\n", updates[0].NameValuePairs, updates[1].NameValuePairs)
 	}
 }
+
+func TestPerformActionReturnsPluginUpdates(t *testing.T) {
+	var as ActionSpec
+	as.URLTemplate = "http://localhost:8080/"
+	as.Method = "GET"
+	as.Tag = "sometag"
+	var env Env
+	env.NameValuePairs = make(map[string]string, 1)
+	env.NameValuePairs["user"] = "monnand"
+
+	rupdates := EmptyEnv()
+	rupdates.NameValuePairs["trace_first_byte"] = "1000"
+	rr := new(responseReaderMock)
+	resp := &Response{
+		Status: 200,
+		Body:   ioutil.NopCloser(&bytes.Buffer{}),
+	}
+	rr.On("ReadResponse", mock.Anything, &env).Return(resp, rupdates, nil)
+	action, err := as.GetAction(rr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	updates, err := action.Perform(&env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(updates) != 1 {
+		t.Fatalf("Got %v updates, instead of 1", len(updates))
+	}
+	if err := envHasValues(updates[0], rupdates.NameValuePairs); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPerformActionWithoutUpdates(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer ts.Close()
+	rr, err := (&HttpResponseReaderFactory{}).NewPlugin(map[string]string{"tls-insecure-skip-verify": "true"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rr.Close()
+	updates, err := performAction(t, &ActionSpec{URLTemplate: ts.URL}, rr, EmptyEnv())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updates != nil {
+		t.Errorf("Should not update the environment: %+v", updates[0])
+	}
+}
+
+func TestPerformActionCapturesHeadersAndStatus(t *testing.T) {
+	var as ActionSpec
+	as.URLTemplate = "http://localhost:8080/"
+	as.Method = "POST"
+	as.Tag = "sometag"
+	as.RespTemps = []string{"id=(?P<id>[0-9]+)"}
+	as.HeaderCaptures = map[string]string{
+		"location": "location",
+		"etag":     "ETag",
+		"missing":  "X-Missing",
+	}
+	as.StatusCapture = "status"
+	var env Env
+	env.NameValuePairs = make(map[string]string, 1)
+
+	h := http.Header{}
+	h.Set("Location", "/users/1")
+	h.Set("ETag", `"abc"`)
+	rr := new(responseReaderMock)
+	resp := &Response{
+		Status: 201,
+		Header: h,
+		Body:   ioutil.NopCloser(bytes.NewBufferString("id=1 id=2")),
+	}
+	rr.On("ReadResponse", mock.Anything, &env).Return(resp, &Env{}, nil)
+	action, err := as.GetAction(rr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	updates, err := action.Perform(&env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(updates) != 2 {
+		t.Fatalf("Got %v updates, instead of 2", len(updates))
+	}
+	for i, u := range updates {
+		exp := map[string]string{
+			"id":       fmt.Sprintf("%v", i+1),
+			"location": "/users/1",
+			"etag":     `"abc"`,
+			"status":   "201",
+		}
+		if !stringMapEq(exp, u.NameValuePairs) {
+			t.Errorf("updates[%v] should be %v, not %v", i, exp, u.NameValuePairs)
+		}
+	}
+}
+
+func TestPerformActionCapturesWithoutTemplates(t *testing.T) {
+	var as ActionSpec
+	as.URLTemplate = "http://localhost:8080/"
+	as.Method = "GET"
+	as.Tag = "sometag"
+	as.StatusCapture = "status"
+	var env Env
+	env.NameValuePairs = make(map[string]string, 1)
+
+	rr := new(responseReaderMock)
+	resp := &Response{
+		Status: 304,
+		Body:   ioutil.NopCloser(&bytes.Buffer{}),
+	}
+	rr.On("ReadResponse", mock.Anything, &env).Return(resp, &Env{}, nil)
+	action, err := as.GetAction(rr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	updates, err := action.Perform(&env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(updates) != 1 {
+		t.Fatalf("Got %v updates, instead of 1", len(updates))
+	}
+	if err := envHasValues(updates[0], map[string]string{"status": "304"}); err != nil {
+		t.Error(err)
+	}
+}
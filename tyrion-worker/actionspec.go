@@ -3,7 +3,6 @@ package main
 import (
 	"crypto/rand"
 	"encoding/base64"
-	"encoding/json"
 	"fmt"
 	"io"
 	"strings"
@@ -23,6 +22,39 @@ type ActionSpec struct {
 	RespTemps   []string            `json:"response-templates,omitempty"`
 	MustMatch   bool                `json:"must-match,omitempty"`
 	MaxNrForks  int                 `json:"max-nr-forks,omitempty"`
+	// Maps variable names to response header names. e.g.
+	// {"location": "Location"} stores the Location header into
+	// {{.location}}.
+	HeaderCaptures map[string]string `json:"response-headers,omitempty"`
+	// The name of the variable in which the status code is stored.
+	StatusCapture string `json:"response-status,omitempty"`
+	// Maps variable names to JSONPath expressions, e.g.
+	// {"id": "$.users[*].id"}. Like the matches of response templates,
+	// each element of an array result forks the environment.
+	RespJSON map[string]string `json:"response-json,omitempty"`
+	// Select nodes from HTML or XML responses.
+	RespNodes []*NodeExtractorSpec `json:"response-nodes,omitempty"`
+	// Checks on the response. Failures are reported as *AssertionError.
+	Assertions []*AssertionSpec `json:"assertions,omitempty"`
+	// The path to a JSON schema file. Responses which do not follow the
+	// schema are reported as *SchemaError.
+	RespSchema string `json:"response-schema,omitempty"`
+	// Variables in the templates are escaped according to where they are
+	// used: in the path or the query of the URL, in response templates (as
+	// regular expressions) or in headers (line breaks are removed). Raw
+	// turns the escaping off for the whole action. Use {{raw .var}} to
+	// turn it off for a single variable.
+	Raw bool `json:"raw,omitempty"`
+	// The action only runs for the environments which meet the condition.
+	// If no action of a step runs for an environment, the environment is
+	// passed to the next step unchanged.
+	When string `json:"when,omitempty"`
+	// The tags of the actions which should finish before this one starts.
+	// Only used in an action graph.
+	DependsOn []string `json:"depends-on,omitempty"`
+	// The time to wait before sending the request. It is not part of the
+	// response time of the request.
+	ThinkTime *ThinkTimeSpec `json:"think-time,omitempty"`
 }
 
 func randomString() string {
@@ -32,11 +64,25 @@ func randomString() string {
 }
 
 func (self *ActionSpec) GetAction(rr ResponseReader) (a *Action, err error) {
+	return self.getAction(rr, nil)
+}
+
+// getAction is like GetAction, but the templates use the given functions
+// instead of the default ones. See newTemplateFuncs.
+func (self *ActionSpec) getAction(rr ResponseReader, funcs template.FuncMap) (a *Action, err error) {
 	ret := new(Action)
-	tmplName := randomString()
-	ret.URLTemplate, err = template.New(tmplName).Parse(self.URLTemplate)
+	// Unless the action is raw, the variables are escaped according to
+	// where they are used.
+	urlCtx := escapeContext(urlContext)
+	regexpCtx := constContext(escaperRegexp)
+	headerCtx := constContext(escaperHeader)
+	if self.Raw {
+		urlCtx = nil
+		regexpCtx = nil
+		headerCtx = nil
+	}
+	ret.URLTemplate, err = parseTemplate(self.URLTemplate, funcs, urlCtx)
 	if err != nil {
-		err = fmt.Errorf("%v is not a valid template: %v", self.URLTemplate, err)
 		return
 	}
 	ret.Method = strings.ToUpper(self.Method)
@@ -56,56 +102,51 @@ func (self *ActionSpec) GetAction(rr ResponseReader) (a *Action, err error) {
 			if len(tmpl) == 0 {
 				continue
 			}
-			t, err = template.New(randomString()).Parse(tmpl)
+			t, err = parseTemplate(tmpl, funcs, regexpCtx)
 			if err != nil {
-				err = fmt.Errorf("%v is not valid template: %v", t, err)
 				return
 			}
 			ret.RespTemps = append(ret.RespTemps, t)
 		}
 	}
+	// The query is encoded when the request is sent.
 	if len(self.URLQuery) > 0 {
-		var paramjs []byte
-		paramjs, err = json.Marshal(self.URLQuery)
+		ret.URLQuery, err = newValuesTemplate(self.URLQuery, funcs, nil)
 		if err != nil {
-			err = fmt.Errorf("%+v is cannot be encoded into json: %v", self.URLQuery, err)
-			return
-		}
-		ret.URLQuery, err = template.New(randomString()).Parse(string(paramjs))
-		if err != nil {
-			err = fmt.Errorf("%v is not a valid template: %v", string(paramjs), err)
 			return
 		}
 	}
 	if len(self.Headers) > 0 {
-		var paramjs []byte
-		paramjs, err = json.Marshal(self.Headers)
-		if err != nil {
-			err = fmt.Errorf("%+v is cannot be encoded into json: %v", self.Headers, err)
-			return
-		}
-		ret.Headers, err = template.New(randomString()).Parse(string(paramjs))
+		ret.Headers, err = newValuesTemplate(self.Headers, funcs, headerCtx)
 		if err != nil {
-			err = fmt.Errorf("%v is not a valid template: %v", string(paramjs), err)
 			return
 		}
 	}
 	if self.Content != nil {
-		ret.Content, err = self.Content.ToTemplate()
+		ret.Content, err = self.Content.toTemplate(funcs)
 		if err != nil {
 			return
 		}
 	}
 	if len(self.Tag) > 0 {
-		ret.Tag, err = template.New(randomString()).Parse(self.Tag)
+		ret.TagText = self.Tag
+		ret.Tag, err = parseTemplate(self.Tag, funcs, nil)
 		if err != nil {
-			err = fmt.Errorf("%v is not a valid template: %v", self.Tag, err)
 			return
 		}
 	} else {
 		err = fmt.Errorf("Action needs a tag to identify itself")
 		return
 	}
+	ret.When, err = newCondition(self.When, funcs)
+	if err != nil {
+		return
+	}
+	ret.ThinkTime, err = self.ThinkTime.getThinkTime()
+	if err != nil {
+		err = fmt.Errorf("Action %v: %v", self.Tag, err)
+		return
+	}
 	ret.ExpStatuses = self.ExpStatuses
 	ret.rr = rr
 	ret.MaxNrForks = self.MaxNrForks
@@ -117,6 +158,45 @@ func (self *ActionSpec) GetAction(rr ResponseReader) (a *Action, err error) {
 
 	ret.Debug = self.Debug
 	ret.MustMatch = self.MustMatch
+	for name, header := range self.HeaderCaptures {
+		if len(name) == 0 || len(header) == 0 {
+			err = fmt.Errorf("Action %v has an empty header capture: %q -> %q", self.Tag, header, name)
+			return
+		}
+	}
+	ret.HeaderCaptures = self.HeaderCaptures
+	ret.StatusCapture = self.StatusCapture
+	if len(self.RespJSON) > 0 {
+		ret.JSONExtractors, err = newJSONExtractors(self.RespJSON)
+		if err != nil {
+			return
+		}
+	}
+	for _, spec := range self.RespNodes {
+		var e *nodeExtractor
+		e, err = spec.getExtractor()
+		if err != nil {
+			return
+		}
+		ret.NodeExtractors = append(ret.NodeExtractors, e)
+	}
+	for _, spec := range self.Assertions {
+		var as *assertion
+		as, err = spec.getAssertion(funcs)
+		if err != nil {
+			err = fmt.Errorf("Action %v: %v", self.Tag, err)
+			return
+		}
+		ret.Assertions = append(ret.Assertions, as)
+	}
+	if len(self.RespSchema) > 0 {
+		ret.Schema, err = loadSchema(self.RespSchema)
+		if err != nil {
+			err = fmt.Errorf("Action %v: %v", self.Tag, err)
+			return
+		}
+		ret.SchemaFile = self.RespSchema
+	}
 	a = ret
 	return
 }
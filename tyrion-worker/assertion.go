@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/PaesslerAG/jsonpath"
+)
+
+// AssertionSpec describes a check on the response of an action. Type can
+// be one of:
+//
+// - body-contains: The body contains Value.
+// - body-not-contains: The body does not contain Value.
+// - json-equals: The value found by the JSONPath Path equals Value.
+// - json-in-range: The number found by the JSONPath Path is within [Min, Max].
+// - header-present: The response has the header Header.
+// - header-equals: The header Header equals Value.
+// - size: The size of the body in bytes is within [Min, Max].
+// - latency: The response, including its body, is received within Value,
+// e.g. 200ms.
+//
+// Value is a template executed against the environment of the action,
+// except for latency. Either Min or Max may be omitted.
+type AssertionSpec struct {
+	Type   string   `json:"type"`
+	Path   string   `json:"path,omitempty"`
+	Header string   `json:"header,omitempty"`
+	Value  string   `json:"value,omitempty"`
+	Min    *float64 `json:"min,omitempty"`
+	Max    *float64 `json:"max,omitempty"`
+}
+
+// AssertionError is reported when some assertions of an action fail.
+type AssertionError struct {
+	Tag      string   `json:"tag"`
+	URL      string   `json:"url"`
+	Env      *Env     `json:"env"`
+	Failures []string `json:"failures"`
+}
+
+func (self *AssertionError) Error() string {
+	return fmt.Sprintf("Tag=%v URL=%v Env=%v: assertion failed: %v",
+		self.Tag, self.URL, self.Env, strings.Join(self.Failures, "; "))
+}
+
+// AssertionFailureRecorder is implemented by response readers which want to
+// know about requests whose responses failed the assertions.
+type AssertionFailureRecorder interface {
+	RecordAssertionFailure(req *Request, err *AssertionError)
+}
+
+type assertion struct {
+	typ        string
+	path       string
+	eval       func(c context.Context, v interface{}) (interface{}, error)
+	header     string
+	value      *template.Template
+	min        *float64
+	max        *float64
+	maxLatency time.Duration
+}
+
+func (self *AssertionSpec) getAssertion(funcs template.FuncMap) (a *assertion, err error) {
+	ret := new(assertion)
+	ret.typ = self.Type
+	ret.min = self.Min
+	ret.max = self.Max
+	ret.header = http.CanonicalHeaderKey(self.Header)
+	needPath := false
+	needHeader := false
+	needValue := false
+	needRange := false
+	switch self.Type {
+	case "body-contains", "body-not-contains":
+		needValue = true
+	case "json-equals":
+		needPath = true
+		needValue = true
+	case "json-in-range":
+		needPath = true
+		needRange = true
+	case "header-present":
+		needHeader = true
+	case "header-equals":
+		needHeader = true
+		needValue = true
+	case "size":
+		needRange = true
+	case "latency":
+		ret.maxLatency, err = time.ParseDuration(self.Value)
+		if err != nil {
+			err = fmt.Errorf("latency assertion has invalid duration %v: %v", self.Value, err)
+			return
+		}
+	default:
+		err = fmt.Errorf("Unknown assertion type: %v", self.Type)
+		return
+	}
+	if needPath {
+		ret.path = self.Path
+		ret.eval, err = jsonpath.New(self.Path)
+		if err != nil {
+			err = fmt.Errorf("%v assertion: %v is not a valid JSONPath: %v", self.Type, self.Path, err)
+			return
+		}
+	}
+	if needHeader && len(self.Header) == 0 {
+		err = fmt.Errorf("%v assertion needs a header", self.Type)
+		return
+	}
+	if needValue {
+		ret.value, err = newTemplate(funcs).Parse(self.Value)
+		if err != nil {
+			err = fmt.Errorf("%v is not a valid template: %v", self.Value, err)
+			return
+		}
+	}
+	if needRange && self.Min == nil && self.Max == nil {
+		err = fmt.Errorf("%v assertion needs min or max", self.Type)
+		return
+	}
+	a = ret
+	return
+}
+
+// assertionInput is what the assertions are checked against. The body is
+// decoded as json at most once.
+type assertionInput struct {
+	vars    *Env
+	resp    *Response
+	body    []byte
+	latency time.Duration
+	doc     interface{}
+	docErr  error
+	decoded bool
+}
+
+func (self *assertionInput) json() (interface{}, error) {
+	if !self.decoded {
+		self.decoded = true
+		self.doc, self.docErr = decodeJSON(self.body)
+	}
+	return self.doc, self.docErr
+}
+
+func (self *assertion) getValue(vars *Env) (value string, err error) {
+	var out bytes.Buffer
+	err = self.value.Execute(&out, vars.NameValuePairs)
+	if err != nil {
+		return
+	}
+	value = out.String()
+	return
+}
+
+func (self *assertion) inRange(v float64) bool {
+	if self.min != nil && v < *self.min {
+		return false
+	}
+	if self.max != nil && v > *self.max {
+		return false
+	}
+	return true
+}
+
+// jsonFloat returns a number decoded from json as a float64. Large integers
+// are approximated.
+func jsonFloat(v interface{}) (f float64, ok bool) {
+	switch x := v.(type) {
+	case float64:
+		return x, true
+	case json.Number:
+		f, err := x.Float64()
+		return f, err == nil
+	}
+	return
+}
+
+func (self *assertion) rangeString() string {
+	min := "-inf"
+	max := "+inf"
+	if self.min != nil {
+		min = strconv.FormatFloat(*self.min, 'f', -1, 64)
+	}
+	if self.max != nil {
+		max = strconv.FormatFloat(*self.max, 'f', -1, 64)
+	}
+	return fmt.Sprintf("[%v, %v]", min, max)
+}
+
+// check returns a description of the failure, or an empty string if the
+// assertion holds.
+func (self *assertion) check(in *assertionInput) string {
+	var value string
+	if self.value != nil {
+		var err error
+		value, err = self.getValue(in.vars)
+		if err != nil {
+			return fmt.Sprintf("%v: invalid value template: %v", self.typ, err)
+		}
+	}
+	var header []string
+	if in.resp != nil {
+		header = in.resp.Header[self.header]
+	}
+	switch self.typ {
+	case "body-contains":
+		if !bytes.Contains(in.body, []byte(value)) {
+			return fmt.Sprintf("body does not contain %q", value)
+		}
+	case "body-not-contains":
+		if bytes.Contains(in.body, []byte(value)) {
+			return fmt.Sprintf("body contains %q", value)
+		}
+	case "json-equals", "json-in-range":
+		doc, err := in.json()
+		if err != nil {
+			return fmt.Sprintf("%v: response is not valid json: %v", self.typ, err)
+		}
+		v, err := self.eval(context.Background(), doc)
+		if err != nil {
+			return fmt.Sprintf("%v: cannot find %v: %v", self.typ, self.path, err)
+		}
+		if self.typ == "json-equals" {
+			if s := jsonValueString(v); s != value {
+				return fmt.Sprintf("%v is %q, not %q", self.path, s, value)
+			}
+			break
+		}
+		f, ok := jsonFloat(v)
+		if !ok {
+			return fmt.Sprintf("%v is %v, not a number", self.path, jsonValueString(v))
+		}
+		if !self.inRange(f) {
+			return fmt.Sprintf("%v is %v, not in %v", self.path, jsonValueString(v), self.rangeString())
+		}
+	case "header-present":
+		if len(header) == 0 {
+			return fmt.Sprintf("header %v is missing", self.header)
+		}
+	case "header-equals":
+		if len(header) == 0 {
+			return fmt.Sprintf("header %v is missing", self.header)
+		}
+		if header[0] != value {
+			return fmt.Sprintf("header %v is %q, not %q", self.header, header[0], value)
+		}
+	case "size":
+		if !self.inRange(float64(len(in.body))) {
+			return fmt.Sprintf("body has %v bytes, not in %v", len(in.body), self.rangeString())
+		}
+	case "latency":
+		if in.latency > self.maxLatency {
+			return fmt.Sprintf("latency %v exceeds %v", in.latency, self.maxLatency)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/mock"
+)
+
+const accountJSON = `{"user": "monnand", "id": 1234567890123456789, "balance": 42.5}`
+
+func accountResponseReader(env *Env) *responseReaderMock {
+	h := http.Header{}
+	h.Set("Content-Type", "application/json")
+	rr := new(responseReaderMock)
+	resp := &Response{
+		Status: 200,
+		Header: h,
+		Body:   ioutil.NopCloser(bytes.NewBufferString(accountJSON)),
+	}
+	rr.On("ReadResponse", mock.Anything, env).Return(resp, &Env{}, nil)
+	return rr
+}
+
+func floatPtr(f float64) *float64 {
+	return &f
+}
+
+func TestAssertionsPass(t *testing.T) {
+	env := EmptyEnv()
+	env.NameValuePairs["user"] = "monnand"
+	assertions := []*AssertionSpec{
+		&AssertionSpec{Type: "body-contains", Value: "{{.user}}"},
+		&AssertionSpec{Type: "body-not-contains", Value: "error"},
+		&AssertionSpec{Type: "json-equals", Path: "$.user", Value: "{{.user}}"},
+		&AssertionSpec{Type: "json-in-range", Path: "$.balance", Min: floatPtr(0), Max: floatPtr(100)},
+		&AssertionSpec{Type: "json-equals", Path: "$.id", Value: "1234567890123456789"},
+		&AssertionSpec{Type: "json-in-range", Path: "$.id", Min: floatPtr(1e18)},
+		&AssertionSpec{Type: "header-present", Header: "content-type"},
+		&AssertionSpec{Type: "header-equals", Header: "Content-Type", Value: "application/json"},
+		&AssertionSpec{Type: "size", Max: floatPtr(1024)},
+		&AssertionSpec{Type: "latency", Value: "1m"},
+	}
+	_, err := performAction(t, &ActionSpec{Assertions: assertions}, accountResponseReader(env), env)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAssertionsFail(t *testing.T) {
+	env := EmptyEnv()
+	env.NameValuePairs["user"] = "turing"
+	assertions := []*AssertionSpec{
+		&AssertionSpec{Type: "body-contains", Value: "{{.user}}"},
+		&AssertionSpec{Type: "body-not-contains", Value: "monnand"},
+		&AssertionSpec{Type: "json-equals", Path: "$.user", Value: "{{.user}}"},
+		&AssertionSpec{Type: "json-in-range", Path: "$.balance", Min: floatPtr(100)},
+		&AssertionSpec{Type: "json-in-range", Path: "$.missing", Max: floatPtr(100)},
+		&AssertionSpec{Type: "json-equals", Path: "$.id", Value: "1234567890123456800"},
+		&AssertionSpec{Type: "header-present", Header: "ETag"},
+		&AssertionSpec{Type: "header-equals", Header: "Content-Type", Value: "text/html"},
+		&AssertionSpec{Type: "size", Min: floatPtr(1024)},
+		&AssertionSpec{Type: "latency", Value: "0s"},
+	}
+	_, err := performAction(t, &ActionSpec{Assertions: assertions}, accountResponseReader(env), env)
+	if err == nil {
+		t.Fatal("Should be an error")
+	}
+	aerr, ok := err.(*AssertionError)
+	if !ok {
+		t.Fatalf("Should be an assertion error: %v", err)
+	}
+	if aerr.Tag != "sometag" {
+		t.Errorf("Wrong tag: %v", aerr.Tag)
+	}
+	if aerr.Env.NameValuePairs["user"] != "turing" {
+		t.Errorf("Wrong env: %v", aerr.Env)
+	}
+	if len(aerr.Failures) != len(assertions) {
+		t.Errorf("Got %v failures, instead of %v: %v", len(aerr.Failures), len(assertions), aerr.Failures)
+	}
+}
+
+func TestInvalidAssertions(t *testing.T) {
+	specs := []*AssertionSpec{
+		&AssertionSpec{Type: "unknown"},
+		&AssertionSpec{Type: "json-equals", Path: "$.[[[", Value: "v"},
+		&AssertionSpec{Type: "json-in-range", Path: "$.a"},
+		&AssertionSpec{Type: "header-present"},
+		&AssertionSpec{Type: "body-contains", Value: "{{.user"},
+		&AssertionSpec{Type: "latency", Value: "fast"},
+	}
+	for _, spec := range specs {
+		as := &ActionSpec{
+			URLTemplate: "http://localhost:8080/",
+			Method:      "GET",
+			Tag:         "sometag",
+			Assertions:  []*AssertionSpec{spec},
+		}
+		_, err := as.GetAction(nil)
+		if err == nil {
+			t.Errorf("%+v should be invalid", spec)
+		}
+	}
+}
+
+func TestTimerCountsAssertionFailures(t *testing.T) {
+	timer, _ := newTestTimer(t, nil, &bodyResponseReader{body: "error"})
+	tagfilter := &pluginTagFilter{plugin: timer}
+	defer tagfilter.Close()
+	assertions := []*AssertionSpec{
+		&AssertionSpec{Type: "body-not-contains", Value: "error"},
+	}
+	for i := 0; i < 3; i++ {
+		_, err := performAction(t, &ActionSpec{Assertions: assertions}, tagfilter, EmptyEnv())
+		if _, ok := err.(*AssertionError); !ok {
+			t.Fatalf("Should be an assertion error: %v", err)
+		}
+	}
+	summaries := tagfilter.LatencySummaries()
+	if len(summaries) != 1 {
+		t.Fatalf("Got %v summaries, instead of 1", len(summaries))
+	}
+	s := summaries[0]
+	if s.Count != 3 || s.Errors != 0 || s.AssertionFailures != 3 {
+		t.Errorf("Wrong summary: %+v", s)
+	}
+}
+
+func TestLatencyAssertion(t *testing.T) {
+	rr := &sleepResponseReader{d: 20 * time.Millisecond}
+	assertions := []*AssertionSpec{
+		&AssertionSpec{Type: "latency", Value: "10ms"},
+	}
+	_, err := performAction(t, &ActionSpec{Assertions: assertions}, rr, EmptyEnv())
+	if _, ok := err.(*AssertionError); !ok {
+		t.Errorf("Should be an assertion error: %v", err)
+	}
+}
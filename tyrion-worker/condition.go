@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// condition decides whether a step runs for an environment. It is either a
+// comparison of two templates, e.g.
+//
+//	{{.role}} == "admin"
+//	{{.token}} != ""
+//
+// or a single template, whose output is false if it is empty, false or 0,
+// and true otherwise, e.g. {{.token}} or {{if eq .role "admin"}}true{{end}}.
+// The operator is found in the condition itself, outside the actions and
+// the quotes, so the values of the variables are never taken as part of
+// the expression. Quotes around an operand are removed before it is
+// executed, and a missing variable is empty.
+type condition struct {
+	text  string
+	op    string
+	left  *template.Template
+	right *template.Template
+}
+
+// splitComparison splits text at the == or != which is outside the actions
+// and the quoted operands. op is empty if there is no such operator.
+func splitComparison(text string) (left, op, right string, err error) {
+	inAction := false
+	var quote byte
+	// Whether only spaces have been seen since the beginning of the
+	// operand. Only a quote there starts a quoted operand.
+	atStart := true
+	idx := -1
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case inAction:
+			if strings.HasPrefix(text[i:], "}}") {
+				inAction = false
+				i++
+			}
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case strings.HasPrefix(text[i:], "{{"):
+			inAction = true
+			atStart = false
+			i++
+		case atStart && (c == '"' || c == '\''):
+			quote = c
+			atStart = false
+		case strings.HasPrefix(text[i:], "==") || strings.HasPrefix(text[i:], "!="):
+			if idx >= 0 {
+				err = fmt.Errorf("%v has more than one comparison", text)
+				return
+			}
+			idx = i
+			atStart = true
+			i++
+		case c != ' ' && c != '\t':
+			atStart = false
+		}
+	}
+	if idx < 0 {
+		left = text
+		return
+	}
+	left = text[:idx]
+	op = text[idx : idx+2]
+	right = text[idx+2:]
+	return
+}
+
+// unquote returns an operand without the spaces and the quotes around it.
+func unquote(s string) string {
+	s = strings.TrimSpace(s)
+	if len(s) >= 2 {
+		if (s[0] == '"' && s[len(s)-1] == '"') || (s[0] == '\'' && s[len(s)-1] == '\'') {
+			return s[1 : len(s)-1]
+		}
+	}
+	return s
+}
+
+func parseOperand(text string, funcs template.FuncMap) (tmpl *template.Template, err error) {
+	tmpl, err = parseTemplate(unquote(text), funcs, nil)
+	if err != nil {
+		return
+	}
+	tmpl.Option("missingkey=zero")
+	return
+}
+
+// newCondition returns nil if text is empty. A nil condition is always
+// true.
+func newCondition(text string, funcs template.FuncMap) (cond *condition, err error) {
+	if len(strings.TrimSpace(text)) == 0 {
+		return
+	}
+	left, op, right, err := splitComparison(text)
+	if err != nil {
+		return
+	}
+	ret := new(condition)
+	ret.text = text
+	ret.op = op
+	ret.left, err = parseOperand(left, funcs)
+	if err != nil {
+		return
+	}
+	if len(op) > 0 {
+		ret.right, err = parseOperand(right, funcs)
+		if err != nil {
+			return
+		}
+	}
+	cond = ret
+	return
+}
+
+func isTrue(s string) bool {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "false", "0":
+		return false
+	}
+	return true
+}
+
+func (self *condition) eval(env *Env) (ok bool, err error) {
+	if self == nil {
+		return true, nil
+	}
+	left, err := executeTemplate(self.left, env)
+	if err != nil {
+		return
+	}
+	if len(self.op) == 0 {
+		ok = isTrue(left)
+		return
+	}
+	right, err := executeTemplate(self.right, env)
+	if err != nil {
+		return
+	}
+	ok = (left == right) == (self.op == "==")
+	return
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestConditionEval(t *testing.T) {
+	env := EmptyEnv()
+	env.NameValuePairs["role"] = "admin"
+	env.NameValuePairs["zero"] = "0"
+	conds := map[string]bool{
+		`{{.role}} == "admin"`:               true,
+		`{{.role}} == 'user'`:                false,
+		`{{.role}} != "user"`:                true,
+		`"{{.missing}}" == ""`:               true,
+		`{{.role}}`:                          true,
+		`{{.zero}}`:                          false,
+		`{{.missing}}`:                       false,
+		`false`:                              false,
+		`{{if eq .role "admin"}}true{{end}}`: true,
+		`{{if eq .role "user"}}true{{end}}`:  false,
+	}
+	for text, exp := range conds {
+		cond, err := newCondition(text, nil)
+		if err != nil {
+			t.Fatalf("%v: %v", text, err)
+		}
+		ok, err := cond.eval(env)
+		if err != nil {
+			t.Fatalf("%v: %v", text, err)
+		}
+		if ok != exp {
+			t.Errorf("%v should be %v", text, exp)
+		}
+	}
+	cond, err := newCondition("  ", nil)
+	if err != nil || cond != nil {
+		t.Errorf("An empty condition should be nil: %v", err)
+	}
+	if ok, _ := cond.eval(env); !ok {
+		t.Errorf("A nil condition should be true")
+	}
+	for _, text := range []string{"{{.role", `{{.a}} == {{.b}} != c`} {
+		if _, err := newCondition(text, nil); err == nil {
+			t.Errorf("%v should be an error", text)
+		}
+	}
+}
+
+// The values of the variables should never be taken as operators or
+// quotes.
+func TestConditionValuesWithOperators(t *testing.T) {
+	env := EmptyEnv()
+	env.NameValuePairs["token"] = "YWI=="
+	env.NameValuePairs["state"] = "x != done"
+	env.NameValuePairs["eq"] = "a==b"
+	env.NameValuePairs["assign"] = "a=b"
+	env.NameValuePairs["quoted"] = `"done"`
+	env.NameValuePairs["empty"] = `""`
+	conds := map[string]bool{
+		`{{.token}}`:                true,
+		`{{.token}} == "YWI=="`:     true,
+		`{{.token}} != "YWI"`:       true,
+		`{{.state}} == "done"`:      false,
+		`{{.state}} != "done"`:      true,
+		`{{.state}} == "x != done"`: true,
+		`{{.eq}} == "a==b"`:         true,
+		`{{.eq}} == 'a'`:            false,
+		`{{.assign}} == "a=b"`:      true,
+		`{{.quoted}} == "done"`:     false,
+		`{{.quoted}} == '"done"'`:   true,
+		`{{.empty}}`:                true,
+		`{{.token}}'s == "YWI=='s"`: true,
+	}
+	for text, exp := range conds {
+		cond, err := newCondition(text, nil)
+		if err != nil {
+			t.Fatalf("%v: %v", text, err)
+		}
+		ok, err := cond.eval(env)
+		if err != nil {
+			t.Fatalf("%v: %v", text, err)
+		}
+		if ok != exp {
+			t.Errorf("%v should be %v", text, exp)
+		}
+	}
+}
+
+// roleResponseReader returns two roles for /roles and records the other
+// requests.
+type roleResponseReader struct {
+	urls []string
+	lock sync.Mutex
+	closer
+}
+
+func (self *roleResponseReader) ReadResponse(req *Request, env *Env) (resp *Response, updates *Env, err error) {
+	body := ""
+	if strings.HasSuffix(req.URL, "/roles") {
+		body = "role=admin role=user"
+	} else {
+		self.lock.Lock()
+		self.urls = append(self.urls, req.URL)
+		self.lock.Unlock()
+	}
+	resp = &Response{Status: 200, Body: ioutil.NopCloser(strings.NewReader(body))}
+	return
+}
+
+func genRoleTask() *TaskSpec {
+	roles := &ActionSpec{
+		Tag:         "roles",
+		URLTemplate: "http://localhost/roles",
+		Method:      "GET",
+		RespTemps:   []string{`role=(?P<role>\w+)`},
+	}
+	taskSpec := new(TaskSpec)
+	taskSpec.ConcurrentActions = []*ConcurrentActions{
+		&ConcurrentActions{Actions: []*ActionSpec{roles}},
+	}
+	return taskSpec
+}
+
+func TestConditionalStep(t *testing.T) {
+	StartWorkers(4)
+	defer StopAllWorkers()
+
+	taskSpec := genRoleTask()
+	admin := &ActionSpec{
+		Tag:           "admin",
+		URLTemplate:   "http://localhost/admin/{{.role}}",
+		Method:        "GET",
+		StatusCapture: "status",
+	}
+	taskSpec.ConcurrentActions = append(taskSpec.ConcurrentActions, &ConcurrentActions{
+		Actions: []*ActionSpec{admin},
+		When:    `{{.role}} == "admin"`,
+	})
+	rr := new(roleResponseReader)
+	envs := runTask(t, taskSpec, rr)
+	if len(rr.urls) != 1 || rr.urls[0] != "http://localhost/admin/admin" {
+		t.Errorf("Wrong requests: %v", rr.urls)
+	}
+	if len(envs) != 2 {
+		t.Fatalf("Got %v envs, instead of 2: %v", len(envs), envs)
+	}
+	for _, env := range envs {
+		_, hasStatus := env.NameValuePairs["status"]
+		if (env.NameValuePairs["role"] == "admin") != hasStatus {
+			t.Errorf("Only the admin should go through the step: %v", env)
+		}
+	}
+}
+
+func TestConditionalActions(t *testing.T) {
+	StartWorkers(4)
+	defer StopAllWorkers()
+
+	taskSpec := genRoleTask()
+	admin := &ActionSpec{
+		Tag:         "admin",
+		URLTemplate: "http://localhost/admin",
+		Method:      "GET",
+		When:        `{{.role}} == "admin"`,
+	}
+	user := &ActionSpec{
+		Tag:         "user",
+		URLTemplate: "http://localhost/user",
+		Method:      "GET",
+		When:        `{{.role}} == "user"`,
+	}
+	guest := &ActionSpec{
+		Tag:         "guest",
+		URLTemplate: "http://localhost/guest",
+		Method:      "GET",
+		When:        `{{.role}} == "guest"`,
+	}
+	taskSpec.ConcurrentActions = append(taskSpec.ConcurrentActions, &ConcurrentActions{
+		Actions:             []*ActionSpec{admin, user, guest},
+		ProceedWhenNoUpdate: true,
+	})
+	rr := new(roleResponseReader)
+	runTask(t, taskSpec, rr)
+	sort.Strings(rr.urls)
+	if len(rr.urls) != 2 || rr.urls[0] != "http://localhost/admin" || rr.urls[1] != "http://localhost/user" {
+		t.Errorf("Wrong requests: %v", rr.urls)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// storedCookie is a cookie of the jar with the URL which set it.
+type storedCookie struct {
+	u      *url.URL
+	cookie *http.Cookie
+}
+
+// envCookieJar is the cookie jar of an Env. The standard cookie jar cannot
+// be copied, so the cookies which are currently set are kept as well and
+// set again into the jar of the copy. A cookie which is set again replaces
+// the kept one, so the copy costs as much as the cookies it has. Max-Age is
+// turned into an expiry time when a cookie is set, so a copy expires its
+// cookies at the same time as the original.
+type envCookieJar struct {
+	lock    sync.Mutex
+	jar     *cookiejar.Jar
+	cookies []*storedCookie
+}
+
+func (self *envCookieJar) getJar() *cookiejar.Jar {
+	if self.jar == nil {
+		// It never fails without options.
+		self.jar, _ = cookiejar.New(nil)
+		for _, s := range self.cookies {
+			self.jar.SetCookies(s.u, []*http.Cookie{s.cookie})
+		}
+	}
+	return self.jar
+}
+
+// cookieKey identifies a cookie by its domain, path and name, like the
+// standard cookie jar does.
+func cookieKey(u *url.URL, c *http.Cookie) string {
+	domain := strings.TrimPrefix(strings.ToLower(c.Domain), ".")
+	if len(domain) == 0 {
+		domain = strings.ToLower(u.Hostname())
+	}
+	path := c.Path
+	if len(path) == 0 || path[0] != '/' {
+		// The default path of RFC 6265.
+		path = "/"
+		if i := strings.LastIndex(u.Path, "/"); i > 0 {
+			path = u.Path[:i]
+		}
+	}
+	return domain + ";" + path + ";" + c.Name
+}
+
+func (self *envCookieJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	if len(cookies) == 0 {
+		return
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.getJar().SetCookies(u, cookies)
+	now := time.Now()
+	for _, c := range cookies {
+		key := cookieKey(u, c)
+		for i, s := range self.cookies {
+			if cookieKey(s.u, s.cookie) == key {
+				self.cookies = append(self.cookies[:i], self.cookies[i+1:]...)
+				break
+			}
+		}
+		if c.MaxAge < 0 {
+			continue
+		}
+		stored := *c
+		if c.MaxAge > 0 {
+			stored.Expires = now.Add(time.Duration(c.MaxAge) * time.Second)
+			stored.MaxAge = 0
+		}
+		if !stored.Expires.IsZero() && !stored.Expires.After(now) {
+			continue
+		}
+		self.cookies = append(self.cookies, &storedCookie{u: u, cookie: &stored})
+	}
+}
+
+func (self *envCookieJar) Cookies(u *url.URL) []*http.Cookie {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if len(self.cookies) == 0 {
+		return nil
+	}
+	return self.getJar().Cookies(u)
+}
+
+func (self *envCookieJar) clone() *envCookieJar {
+	ret := new(envCookieJar)
+	if self == nil {
+		return ret
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	now := time.Now()
+	ret.cookies = make([]*storedCookie, 0, len(self.cookies))
+	for _, s := range self.cookies {
+		if !s.cookie.Expires.IsZero() && !s.cookie.Expires.After(now) {
+			continue
+		}
+		ret.cookies = append(ret.cookies, s)
+	}
+	return ret
+}
+
+// cookieEnv returns the cookies which would be sent to u as variables
+// named cookie_<name>.
+func cookieEnv(jar http.CookieJar, u *url.URL) *Env {
+	ret := EmptyEnv()
+	for _, c := range jar.Cookies(u) {
+		ret.NameValuePairs["cookie_"+c.Name] = c.Value
+	}
+	return ret
+}
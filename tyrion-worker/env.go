@@ -4,18 +4,32 @@ import (
 	"crypto/sha256"
 	"encoding/json"
 	"fmt"
+	"net/http"
 )
 
+// The cookie jar is not considered when comparing two environments. An
+// environment created by EmptyEnv() starts with an empty jar and its clones
+// get a copy of its jar.
 type Env struct {
 	NameValuePairs map[string]string `json:"vars"`
+	jar            *envCookieJar
 }
 
 func EmptyEnv() *Env {
 	ret := new(Env)
 	ret.NameValuePairs = make(map[string]string, 10)
+	ret.jar = new(envCookieJar)
 	return ret
 }
 
+// CookieJar returns nil if the environment has no cookie jar.
+func (self *Env) CookieJar() http.CookieJar {
+	if self == nil || self.jar == nil {
+		return nil
+	}
+	return self.jar
+}
+
 func (self *Env) IsEmpty() bool {
 	return self == nil || len(self.NameValuePairs) == 0
 }
@@ -45,14 +59,12 @@ func (self *Env) Clone() *Env {
 	if self == nil {
 		return EmptyEnv()
 	}
-	if len(self.NameValuePairs) == 0 {
-		return EmptyEnv()
-	}
 	ret := new(Env)
 	ret.NameValuePairs = make(map[string]string, len(self.NameValuePairs))
 	for k, v := range self.NameValuePairs {
 		ret.NameValuePairs[k] = v
 	}
+	ret.jar = self.jar.clone()
 	return ret
 }
 
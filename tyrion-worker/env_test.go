@@ -1,6 +1,12 @@
 package main
 
-import "testing"
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
 
 func TestEnvClone(t *testing.T) {
 	env := new(Env)
@@ -44,3 +50,58 @@ func TestEnvUpdate(t *testing.T) {
 		t.Errorf("Got %v forks, not 2.", len(forks))
 	}
 }
+
+func TestEnvForkCopiesCookies(t *testing.T) {
+	u, _ := url.Parse("http://localhost/")
+	env := EmptyEnv()
+	env.CookieJar().SetCookies(u, []*http.Cookie{&http.Cookie{Name: "session", Value: "parent"}})
+
+	n := EmptyEnv()
+	n.NameValuePairs["k1"] = "v1"
+	forks := env.Fork(n)
+	if len(forks) != 1 {
+		t.Fatalf("Got %v forks, not 1.", len(forks))
+	}
+	child := forks[0]
+	cookies := child.CookieJar().Cookies(u)
+	if len(cookies) != 1 || cookies[0].Value != "parent" {
+		t.Errorf("Child should inherit the cookies: %v", cookies)
+	}
+
+	child.CookieJar().SetCookies(u, []*http.Cookie{&http.Cookie{Name: "session", Value: "child"}})
+	cookies = env.CookieJar().Cookies(u)
+	if len(cookies) != 1 || cookies[0].Value != "parent" {
+		t.Errorf("Parent should not be changed by the child: %v", cookies)
+	}
+	cookies = child.CookieJar().Cookies(u)
+	if len(cookies) != 1 || cookies[0].Value != "child" {
+		t.Errorf("Child should have its own cookie: %v", cookies)
+	}
+}
+
+func TestEnvForkCopiesCurrentCookies(t *testing.T) {
+	u, _ := url.Parse("http://localhost/a/b")
+	env := EmptyEnv()
+	jar := env.CookieJar()
+	for i := 0; i < 100; i++ {
+		jar.SetCookies(u, []*http.Cookie{&http.Cookie{Name: "session", Value: fmt.Sprintf("%v", i), Path: "/"}})
+	}
+	jar.SetCookies(u, []*http.Cookie{&http.Cookie{Name: "deleted", Value: "v"}})
+	jar.SetCookies(u, []*http.Cookie{&http.Cookie{Name: "deleted", MaxAge: -1}})
+	set := time.Now()
+	jar.SetCookies(u, []*http.Cookie{&http.Cookie{Name: "short", Value: "v", MaxAge: 1}})
+
+	child := env.Clone()
+	if n := len(child.jar.cookies); n != 2 {
+		t.Errorf("Child should keep 2 cookies, not %v", n)
+	}
+	cookies := cookieEnv(child.CookieJar(), u).NameValuePairs
+	if len(cookies) != 2 || cookies["cookie_session"] != "99" || cookies["cookie_short"] != "v" {
+		t.Errorf("Child should have the current cookies: %v", cookies)
+	}
+	for _, s := range child.jar.cookies {
+		if s.cookie.Name == "short" && s.cookie.Expires.After(set.Add(2*time.Second)) {
+			t.Errorf("The cookie should expire 1s after it was set, not at %v", s.cookie.Expires)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"text/template"
+	"text/template/parse"
+)
+
+// The escapers are appended to the pipelines of the actions in a template,
+// like the escapers of html/template. An action whose last command is raw
+// is not escaped, e.g. {{raw .base}} or {{.base | raw}}.
+const (
+	escaperPath   = "escapePath"
+	escaperQuery  = "escapeQuery"
+	escaperRegexp = "escapeRegexp"
+	escaperHeader = "escapeHeader"
+	escaperRaw    = "raw"
+)
+
+var escaperFuncs = template.FuncMap{
+	escaperPath: func(v interface{}) string {
+		return url.PathEscape(fmt.Sprint(v))
+	},
+	escaperQuery: func(v interface{}) string {
+		return url.QueryEscape(fmt.Sprint(v))
+	},
+	escaperRegexp: func(v interface{}) string {
+		return regexp.QuoteMeta(fmt.Sprint(v))
+	},
+	// Line breaks in a header value would start a new header.
+	escaperHeader: func(v interface{}) string {
+		return strings.NewReplacer("\r", "", "\n", "").Replace(fmt.Sprint(v))
+	},
+	escaperRaw: func(v interface{}) string {
+		return fmt.Sprint(v)
+	},
+}
+
+// An escapeContext returns the escaper for an action given the text before
+// the action, or an empty string if the action should not be escaped.
+type escapeContext func(prefix string) string
+
+// urlContext escapes the actions in the path of a URL with escapePath and
+// those in the query or the fragment with escapeQuery. The actions at the
+// beginning of the URL, or before the path, are not escaped so that a
+// variable may hold the scheme and the host.
+func urlContext(prefix string) string {
+	if strings.ContainsAny(prefix, "?#") {
+		return escaperQuery
+	}
+	if idx := strings.Index(prefix, "://"); idx >= 0 {
+		if strings.Contains(prefix[idx+3:], "/") {
+			return escaperPath
+		}
+		return ""
+	}
+	if len(prefix) == 0 {
+		return ""
+	}
+	return escaperPath
+}
+
+func constContext(escaper string) escapeContext {
+	return func(prefix string) string {
+		return escaper
+	}
+}
+
+func isRaw(pipe *parse.PipeNode) bool {
+	if len(pipe.Cmds) == 0 {
+		return false
+	}
+	cmd := pipe.Cmds[len(pipe.Cmds)-1]
+	if len(cmd.Args) == 0 {
+		return false
+	}
+	ident, ok := cmd.Args[0].(*parse.IdentifierNode)
+	return ok && ident.Ident == escaperRaw
+}
+
+// escapeList appends escapers to the actions in the list and returns the
+// text seen so far. The text in both branches of if, range and with is
+// considered to be before the actions after them.
+func escapeList(list *parse.ListNode, ctx escapeContext, prefix string) string {
+	if list == nil {
+		return prefix
+	}
+	for _, node := range list.Nodes {
+		switch n := node.(type) {
+		case *parse.TextNode:
+			prefix += string(n.Text)
+		case *parse.ActionNode:
+			// Actions which only declare variables print nothing.
+			if len(n.Pipe.Decl) > 0 || isRaw(n.Pipe) {
+				continue
+			}
+			escaper := ctx(prefix)
+			if len(escaper) == 0 {
+				continue
+			}
+			cmd := &parse.CommandNode{
+				NodeType: parse.NodeCommand,
+				Pos:      n.Pos,
+				Args:     []parse.Node{parse.NewIdentifier(escaper).SetPos(n.Pos)},
+			}
+			n.Pipe.Cmds = append(n.Pipe.Cmds, cmd)
+		case *parse.IfNode:
+			prefix = escapeList(n.ElseList, ctx, escapeList(n.List, ctx, prefix))
+		case *parse.RangeNode:
+			prefix = escapeList(n.ElseList, ctx, escapeList(n.List, ctx, prefix))
+		case *parse.WithNode:
+			prefix = escapeList(n.ElseList, ctx, escapeList(n.List, ctx, prefix))
+		}
+	}
+	return prefix
+}
+
+// parseTemplate parses text with the functions and the escapers. If ctx is
+// nil, the actions are not escaped.
+func parseTemplate(text string, funcs template.FuncMap, ctx escapeContext) (tmpl *template.Template, err error) {
+	tmpl, err = newTemplate(funcs).Funcs(escaperFuncs).Parse(text)
+	if err != nil {
+		err = fmt.Errorf("%v is not a valid template: %v", text, err)
+		return
+	}
+	if ctx != nil && tmpl.Tree != nil {
+		escapeList(tmpl.Tree.Root, ctx, "")
+	}
+	return
+}
+
+func executeTemplate(tmpl *template.Template, vars *Env) (str string, err error) {
+	var out bytes.Buffer
+	var data map[string]string
+	if vars != nil {
+		data = vars.NameValuePairs
+	}
+	err = tmpl.Execute(&out, data)
+	if err != nil {
+		return
+	}
+	str = out.String()
+	return
+}
+
+// valuesTemplate templates each key and value of a map, like url.Values or
+// http.Header, separately.
+type valuesTemplate struct {
+	keys   []*template.Template
+	values [][]*template.Template
+}
+
+func newValuesTemplate(m map[string][]string, funcs template.FuncMap, ctx escapeContext) (tmpl *valuesTemplate, err error) {
+	if m == nil {
+		return
+	}
+	ret := new(valuesTemplate)
+	for k, vs := range m {
+		var kt *template.Template
+		kt, err = parseTemplate(k, funcs, ctx)
+		if err != nil {
+			return
+		}
+		vts := make([]*template.Template, len(vs))
+		for i, v := range vs {
+			vts[i], err = parseTemplate(v, funcs, ctx)
+			if err != nil {
+				return
+			}
+		}
+		ret.keys = append(ret.keys, kt)
+		ret.values = append(ret.values, vts)
+	}
+	tmpl = ret
+	return
+}
+
+// execute returns nil if the template is nil. Values of keys which are the
+// same after being executed are appended.
+func (self *valuesTemplate) execute(vars *Env) (m map[string][]string, err error) {
+	if self == nil {
+		return
+	}
+	ret := make(map[string][]string, len(self.keys))
+	for i, kt := range self.keys {
+		var k string
+		k, err = executeTemplate(kt, vars)
+		if err != nil {
+			return
+		}
+		vs := ret[k]
+		if vs == nil {
+			vs = make([]string, 0, len(self.values[i]))
+		}
+		for _, vt := range self.values[i] {
+			var v string
+			v, err = executeTemplate(vt, vars)
+			if err != nil {
+				return
+			}
+			vs = append(vs, v)
+		}
+		ret[k] = vs
+	}
+	m = ret
+	return
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"testing"
+)
+
+func escapeTestEnv() *Env {
+	env := EmptyEnv()
+	env.NameValuePairs["base"] = "http://localhost:8080/api"
+	env.NameValuePairs["user"] = `a b/c?d"e\`
+	env.NameValuePairs["q"] = "x&y=z #1"
+	env.NameValuePairs["multiline"] = "line1\r\nX-Injected: 1"
+	return env
+}
+
+func TestURLEscaping(t *testing.T) {
+	env := escapeTestEnv()
+	urls := map[string]string{
+		"http://localhost/{{.user}}":                             `http://localhost/a%20b%2Fc%3Fd%22e%5C`,
+		"http://localhost/s?q={{.q}}":                            "http://localhost/s?q=x%26y%3Dz+%231",
+		"http://localhost/s#{{.q}}":                              "http://localhost/s#x%26y%3Dz+%231",
+		"{{.base}}/users/{{.user}}":                              `http://localhost:8080/api/users/a%20b%2Fc%3Fd%22e%5C`,
+		"http://localhost/{{raw .user}}":                         `http://localhost/a b/c?d"e\`,
+		"http://localhost/{{.user | raw}}":                       `http://localhost/a b/c?d"e\`,
+		"http://{{.q}}/":                                         "http://x&y=z #1/",
+		"http://localhost/{{if .user}}{{.user}}{{end}}?q={{.q}}": `http://localhost/a%20b%2Fc%3Fd%22e%5C?q=x%26y%3Dz+%231`,
+		"http://localhost/{{$u := .user}}{{$u}}":                 `http://localhost/a%20b%2Fc%3Fd%22e%5C`,
+	}
+	for tmpl, exp := range urls {
+		as := &ActionSpec{URLTemplate: tmpl, Method: "GET", Tag: "sometag"}
+		action, err := as.GetAction(nil)
+		if err != nil {
+			t.Fatalf("%v: %v", tmpl, err)
+		}
+		u, err := action.getURL(env)
+		if err != nil {
+			t.Fatalf("%v: %v", tmpl, err)
+		}
+		if u != exp {
+			t.Errorf("%v should be %v, not %v", tmpl, exp, u)
+		}
+	}
+}
+
+func TestRawAction(t *testing.T) {
+	as := &ActionSpec{
+		URLTemplate: "http://localhost/{{.user}}",
+		Method:      "GET",
+		Tag:         "sometag",
+		Headers:     map[string][]string{"X-Data": []string{"{{.multiline}}"}},
+		Raw:         true,
+	}
+	action, err := as.GetAction(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := escapeTestEnv()
+	u, err := action.getURL(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := `http://localhost/a b/c?d"e\`; u != exp {
+		t.Errorf("URL should be %v, not %v", exp, u)
+	}
+	h, err := action.getHeaders(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := h.Get("X-Data"); v != env.NameValuePairs["multiline"] {
+		t.Errorf("Wrong header: %q", v)
+	}
+}
+
+func TestQueryAndHeaderLeafTemplates(t *testing.T) {
+	as := &ActionSpec{
+		URLTemplate: "http://localhost/",
+		Method:      "GET",
+		Tag:         "sometag",
+		URLQuery: map[string][]string{
+			"name":          []string{"{{.user}}", "static"},
+			"key-{{.user}}": []string{"{{.q}}"},
+		},
+		Headers: map[string][]string{
+			"X-User": []string{"{{.user}}"},
+			"X-Data": []string{"{{.multiline}}"},
+		},
+	}
+	action, err := as.GetAction(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := escapeTestEnv()
+	params, err := action.getParams(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := env.NameValuePairs["user"]
+	if vs := params["name"]; len(vs) != 2 || vs[0] != user || vs[1] != "static" {
+		t.Errorf("Wrong query: %v", params)
+	}
+	if v := params.Get("key-" + user); v != env.NameValuePairs["q"] {
+		t.Errorf("Wrong query: %v", params)
+	}
+	headers, err := action.getHeaders(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := headers.Get("X-User"); v != user {
+		t.Errorf("Wrong header: %q", v)
+	}
+	if v := headers.Get("X-Data"); v != "line1X-Injected: 1" {
+		t.Errorf("Line breaks should be removed: %q", v)
+	}
+}
+
+func TestContentLeafTemplates(t *testing.T) {
+	c := &HttpRequestContent{
+		RawContent: `{"user": "{{.user}}"}`,
+		Form:       map[string][]string{"user": []string{"{{.user}}"}},
+		MultiPart: &MultiPartContentSpec{
+			Files: []*MultiPartFileSpec{
+				&MultiPartFileSpec{Field: "file", Filename: "#{{.q}}", Content: "{{.user}}"},
+			},
+		},
+	}
+	tmpl, err := c.ToTemplate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := escapeTestEnv()
+	content, err := NewContent(tmpl, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := env.NameValuePairs["user"]
+	if exp := `{"user": "` + user + `"}`; content.RawContent != exp {
+		t.Errorf("Raw content should be %v, not %v", exp, content.RawContent)
+	}
+	if v := content.Form["user"]; len(v) != 1 || v[0] != user {
+		t.Errorf("Wrong form: %v", content.Form)
+	}
+	f := content.MultiPart.Files[0]
+	if f.Filename != "#"+env.NameValuePairs["q"] || f.Content != user {
+		t.Errorf("Wrong file: %+v", f)
+	}
+}
+
+func TestResponseTemplateEscaping(t *testing.T) {
+	as := &ActionSpec{
+		URLTemplate: "http://localhost/",
+		Method:      "GET",
+		Tag:         "sometag",
+		RespTemps:   []string{`{{.name}}: (?P<tel>[0-9]+)`},
+	}
+	action, err := as.GetAction(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := EmptyEnv()
+	env.NameValuePairs["name"] = "a.b+(c"
+	pattern, err := action.getRespPattern(env, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pattern.MatchString("a.b+(c: 123") {
+		t.Errorf("%v should match the literal name", pattern)
+	}
+	if pattern.MatchString("axbb(c: 123") {
+		t.Errorf("%v should not treat the name as a regular expression", pattern)
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// FeederSpec reads rows of variables from a file. Each iteration of the
+// task takes one row from each feeder and starts with the variables of the
+// rows added to the initial environment.
+//
+// Format can be csv, whose first line names the variables, or jsonl, in
+// which each line is a json object. If it is empty, the format is decided
+// by the extension of the file.
+//
+// Mode can be one of:
+// - sequential: The rows are taken in order. The task stops starting new
+// iterations after the last row. This is the default.
+// - circular: Like sequential, but starts over after the last row.
+// - random: A random row is taken each time.
+//
+// If Unique is true, a row is used by at most one running iteration at a
+// time. An iteration waits until a row is free.
+type FeederSpec struct {
+	File   string `json:"file"`
+	Format string `json:"format,omitempty"`
+	Mode   string `json:"mode,omitempty"`
+	Unique bool   `json:"unique,omitempty"`
+}
+
+const (
+	feedSequential = iota
+	feedCircular
+	feedRandom
+)
+
+type feeder struct {
+	file   string
+	rows   []map[string]string
+	mode   int
+	unique bool
+	rnd    *rand.Rand
+	lock   sync.Mutex
+	free   *sync.Cond
+	next   int
+	inUse  []bool
+	nrUsed int
+}
+
+func readCSVRows(r io.Reader) (rows []map[string]string, err error) {
+	records, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return
+	}
+	if len(records) == 0 {
+		return
+	}
+	header := records[0]
+	rows = make([]map[string]string, 0, len(records)-1)
+	for _, record := range records[1:] {
+		row := make(map[string]string, len(header))
+		for i, name := range header {
+			row[name] = record[i]
+		}
+		rows = append(rows, row)
+	}
+	return
+}
+
+func readJSONLRows(r io.Reader) (rows []map[string]string, err error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	n := 0
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 {
+			continue
+		}
+		var doc interface{}
+		doc, err = decodeJSON([]byte(line))
+		if err != nil {
+			err = fmt.Errorf("line %v is not a json object: %v", n, err)
+			return
+		}
+		obj, ok := doc.(map[string]interface{})
+		if !ok {
+			err = fmt.Errorf("line %v is not a json object", n)
+			return
+		}
+		row := make(map[string]string, len(obj))
+		for k, v := range obj {
+			row[k] = jsonValueString(v)
+		}
+		rows = append(rows, row)
+	}
+	err = scanner.Err()
+	return
+}
+
+func (self *FeederSpec) getFeeder(rnd *rand.Rand) (f *feeder, err error) {
+	ret := new(feeder)
+	ret.file = self.File
+	ret.unique = self.Unique
+	ret.rnd = rnd
+	ret.free = sync.NewCond(&ret.lock)
+	switch self.Mode {
+	case "", "sequential":
+		ret.mode = feedSequential
+	case "circular":
+		ret.mode = feedCircular
+	case "random":
+		ret.mode = feedRandom
+	default:
+		err = fmt.Errorf("feeder %v: unknown mode %v", self.File, self.Mode)
+		return
+	}
+	format := self.Format
+	if len(format) == 0 {
+		format = strings.TrimPrefix(filepath.Ext(self.File), ".")
+	}
+	var read func(r io.Reader) ([]map[string]string, error)
+	switch strings.ToLower(format) {
+	case "csv":
+		read = readCSVRows
+	case "jsonl":
+		read = readJSONLRows
+	default:
+		err = fmt.Errorf("feeder %v: unknown format %v", self.File, format)
+		return
+	}
+	file, err := os.Open(self.File)
+	if err != nil {
+		err = fmt.Errorf("feeder %v: %v", self.File, err)
+		return
+	}
+	defer file.Close()
+	ret.rows, err = read(file)
+	if err != nil {
+		err = fmt.Errorf("feeder %v: %v", self.File, err)
+		return
+	}
+	if len(ret.rows) == 0 {
+		err = fmt.Errorf("feeder %v has no rows", self.File)
+		return
+	}
+	ret.inUse = make([]bool, len(ret.rows))
+	f = ret
+	return
+}
+
+// pick returns the index of the next row to use, or -1 if there is no row
+// to use now. exhausted is true if no row will ever be available again.
+func (self *feeder) pick() (idx int, exhausted bool) {
+	switch self.mode {
+	case feedSequential:
+		if self.next >= len(self.rows) {
+			return -1, true
+		}
+		idx = self.next
+		self.next++
+		return
+	case feedCircular:
+		for i := 0; i < len(self.rows); i++ {
+			idx = (self.next + i) % len(self.rows)
+			if !self.unique || !self.inUse[idx] {
+				self.next = idx + 1
+				return
+			}
+		}
+	case feedRandom:
+		if !self.unique {
+			return self.rnd.Intn(len(self.rows)), false
+		}
+		if nrFree := len(self.rows) - self.nrUsed; nrFree > 0 {
+			n := self.rnd.Intn(nrFree)
+			for i, used := range self.inUse {
+				if used {
+					continue
+				}
+				if n == 0 {
+					return i, false
+				}
+				n--
+			}
+		}
+	}
+	return -1, false
+}
+
+// acquire returns the index of a row, waiting for a free one if the rows
+// are unique. ok is false if there will be no more rows.
+func (self *feeder) acquire() (idx int, ok bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for {
+		var exhausted bool
+		idx, exhausted = self.pick()
+		if exhausted {
+			return -1, false
+		}
+		if idx >= 0 {
+			break
+		}
+		self.free.Wait()
+	}
+	if self.unique {
+		self.inUse[idx] = true
+		self.nrUsed++
+	}
+	return idx, true
+}
+
+func (self *feeder) release(idx int) {
+	if !self.unique {
+		return
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.inUse[idx] = false
+	self.nrUsed--
+	self.free.Signal()
+}
+
+// feederLease is a row taken from a feeder by an iteration.
+type feederLease struct {
+	feeder *feeder
+	idx    int
+}
+
+// feed takes one row from each feeder for the iteration. It returns false
+// if a feeder has no more rows, in which case nothing is taken.
+func (self *worker) feed(it *iteration) bool {
+	if len(self.feeders) == 0 {
+		return true
+	}
+	vars := EmptyEnv()
+	leases := make([]*feederLease, 0, len(self.feeders))
+	for _, f := range self.feeders {
+		idx, ok := f.acquire()
+		if !ok {
+			for _, l := range leases {
+				l.feeder.release(l.idx)
+			}
+			return false
+		}
+		leases = append(leases, &feederLease{feeder: f, idx: idx})
+		for k, v := range f.rows[idx] {
+			vars.NameValuePairs[k] = v
+		}
+	}
+	it.vars = vars
+	it.leases = leases
+	return true
+}
+
+// release gives the rows taken by the iteration back to the feeders.
+func (self *worker) release(it *iteration) {
+	for _, l := range it.leases {
+		l.feeder.release(l.idx)
+	}
+	it.leases = nil
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeFeederFile(t *testing.T, name, content string) string {
+	dir, err := ioutil.TempDir("", "tyrion-feeder")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	filename := filepath.Join(dir, name)
+	err = ioutil.WriteFile(filename, []byte(content), 0600)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	return filename
+}
+
+const usersCSV = `user,city
+alice,paris
+bob,london
+carol,tokyo
+`
+
+func runFeederTask(t *testing.T, feeders []*FeederSpec, load *LoadSpec) []string {
+	taskSpec := genSingleActionTask()
+	taskSpec.ConcurrentActions[0].Actions[0].URLTemplate = "http://localhost/{{.user}}/{{.city}}"
+	taskSpec.Feeders = feeders
+	taskSpec.Load = load
+	rr := new(urlRecorder)
+	runTask(t, taskSpec, rr)
+	sort.Strings(rr.urls)
+	return rr.urls
+}
+
+func TestSequentialFeeder(t *testing.T) {
+	StartWorkers(10)
+	defer StopAllWorkers()
+	filename := writeFeederFile(t, "users.csv", usersCSV)
+	defer os.RemoveAll(filepath.Dir(filename))
+
+	start := time.Now()
+	urls := runFeederTask(t, []*FeederSpec{&FeederSpec{File: filename}}, &LoadSpec{Rate: 100, Duration: "10s"})
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("The load should stop when the rows run out. Took %v", d)
+	}
+	exp := []string{
+		"http://localhost/alice/paris",
+		"http://localhost/bob/london",
+		"http://localhost/carol/tokyo",
+	}
+	if len(urls) != len(exp) {
+		t.Fatalf("Got %v, instead of %v", urls, exp)
+	}
+	for i, u := range urls {
+		if u != exp[i] {
+			t.Errorf("Got %v, instead of %v", u, exp[i])
+		}
+	}
+}
+
+func TestSequentialFeederWithVirtualUsers(t *testing.T) {
+	StartWorkers(10)
+	defer StopAllWorkers()
+	filename := writeFeederFile(t, "users.csv", usersCSV)
+	defer os.RemoveAll(filepath.Dir(filename))
+
+	start := time.Now()
+	urls := runFeederTask(t, []*FeederSpec{&FeederSpec{File: filename}}, &LoadSpec{VirtualUsers: 2, Duration: "10s"})
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("The virtual users should stop when the rows run out. Took %v", d)
+	}
+	exp := []string{
+		"http://localhost/alice/paris",
+		"http://localhost/bob/london",
+		"http://localhost/carol/tokyo",
+	}
+	if len(urls) != len(exp) {
+		t.Fatalf("Got %v, instead of %v", urls, exp)
+	}
+	for i, u := range urls {
+		if u != exp[i] {
+			t.Errorf("Got %v, instead of %v", u, exp[i])
+		}
+	}
+}
+
+func TestFeederWithoutLoad(t *testing.T) {
+	StartWorkers(1)
+	defer StopAllWorkers()
+	filename := writeFeederFile(t, "users.csv", usersCSV)
+	defer os.RemoveAll(filepath.Dir(filename))
+
+	urls := runFeederTask(t, []*FeederSpec{&FeederSpec{File: filename}}, nil)
+	if len(urls) != 1 || urls[0] != "http://localhost/alice/paris" {
+		t.Errorf("Wrong requests: %v", urls)
+	}
+}
+
+func TestCircularJSONLFeeder(t *testing.T) {
+	StartWorkers(10)
+	defer StopAllWorkers()
+	users := writeFeederFile(t, "users.jsonl", "{\"user\": \"alice\"}\n\n{\"user\": \"bob\"}\n")
+	defer os.RemoveAll(filepath.Dir(users))
+	cities := writeFeederFile(t, "cities.txt", "{\"city\": \"paris\"}\n")
+	defer os.RemoveAll(filepath.Dir(cities))
+
+	feeders := []*FeederSpec{
+		&FeederSpec{File: users, Mode: "circular"},
+		&FeederSpec{File: cities, Mode: "random", Format: "jsonl"},
+	}
+	urls := runFeederTask(t, feeders, &LoadSpec{Rate: 1000, Duration: "1s", MaxNrIterations: 5})
+	count := make(map[string]int, 2)
+	for _, u := range urls {
+		count[u]++
+	}
+	if count["http://localhost/alice/paris"] != 3 || count["http://localhost/bob/paris"] != 2 {
+		t.Errorf("Wrong requests: %v", urls)
+	}
+}
+
+func TestJSONLFeederNumbers(t *testing.T) {
+	rows, err := readJSONLRows(strings.NewReader("{\"id\": 1234567890123456789, \"score\": 0.5}\n"))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if len(rows) != 1 || rows[0]["id"] != "1234567890123456789" || rows[0]["score"] != "0.5" {
+		t.Errorf("Wrong rows: %v", rows)
+	}
+}
+
+func TestUniqueFeeder(t *testing.T) {
+	filename := writeFeederFile(t, "users.csv", usersCSV)
+	defer os.RemoveAll(filepath.Dir(filename))
+	for _, mode := range []string{"circular", "random"} {
+		spec := &FeederSpec{File: filename, Mode: mode, Unique: true}
+		f, err := spec.getFeeder(rand.New(rand.NewSource(1)))
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		used := make(map[int]bool, 3)
+		for i := 0; i < 3; i++ {
+			idx, ok := f.acquire()
+			if !ok || used[idx] {
+				t.Fatalf("%v: row %v is taken twice", mode, idx)
+			}
+			used[idx] = true
+		}
+		ch := make(chan int)
+		go func() {
+			idx, _ := f.acquire()
+			ch <- idx
+		}()
+		select {
+		case idx := <-ch:
+			t.Fatalf("%v: row %v is taken while all rows are in use", mode, idx)
+		case <-time.After(50 * time.Millisecond):
+		}
+		f.release(1)
+		if idx := <-ch; idx != 1 {
+			t.Errorf("%v: got row %v, instead of the released row", mode, idx)
+		}
+	}
+}
+
+func TestInvalidFeeders(t *testing.T) {
+	filename := writeFeederFile(t, "users.csv", usersCSV)
+	defer os.RemoveAll(filepath.Dir(filename))
+	empty := writeFeederFile(t, "empty.csv", "user\n")
+	defer os.RemoveAll(filepath.Dir(empty))
+	bad := writeFeederFile(t, "bad.jsonl", "[1, 2]\n")
+	defer os.RemoveAll(filepath.Dir(bad))
+
+	specs := []*FeederSpec{
+		&FeederSpec{File: filename, Mode: "shuffle"},
+		&FeederSpec{File: filename, Format: "xml"},
+		&FeederSpec{File: filename + ".missing"},
+		&FeederSpec{File: empty},
+		&FeederSpec{File: bad},
+	}
+	for _, spec := range specs {
+		taskSpec := genSingleActionTask()
+		taskSpec.Feeders = []*FeederSpec{spec}
+		_, err := taskSpec.GetWorker(new(urlRecorder))
+		if err == nil {
+			t.Errorf("%+v should be invalid", spec)
+		}
+	}
+}
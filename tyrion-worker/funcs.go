@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"net/url"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// lockedSource makes a rand.Source safe for concurrent use.
+type lockedSource struct {
+	lock sync.Mutex
+	src  rand.Source
+}
+
+func (self *lockedSource) Int63() int64 {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.src.Int63()
+}
+
+func (self *lockedSource) Seed(seed int64) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.src.Seed(seed)
+}
+
+const randStringLetters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+// newTemplateFuncs returns the functions available in all templates of an
+// action. The random functions draw from a source with the given seed, so
+// the same seed produces the same values if the actions run in the same
+// order.
+//
+// - uuid: A random (version 4) UUID.
+// - randInt min max: A random integer in [min, max].
+// - randString n: A random string of n letters and digits.
+// - pick a b c...: One of the arguments. A single argument is split by
+// commas, so {{pick .users}} works with users set to "alice,bob".
+// - now: The current time. e.g. {{now.Year}}
+// - unixTime, unixMilli: The current unix time in seconds or milliseconds.
+// - rfc3339: The current time in RFC 3339.
+// - base64, base64url: Base64 encoding with the standard or URL alphabet.
+// - pathEscape, queryEscape: Escape a string for a URL path or query.
+// - md5, sha1, sha256: The hex encoded hash of a string.
+// - hmac key msg: The hex encoded HMAC-SHA256 of msg.
+//
+// See escaperFuncs for the functions which escape the variables.
+func newTemplateFuncs(seed int64) template.FuncMap {
+	rnd := rand.New(&lockedSource{src: rand.NewSource(seed)})
+	return template.FuncMap{
+		"uuid": func() string {
+			var b [16]byte
+			for i := 0; i < len(b); i += 8 {
+				v := rnd.Int63()
+				for j := 0; j < 8; j++ {
+					b[i+j] = byte(v >> uint(8*j))
+				}
+			}
+			b[6] = (b[6] & 0x0f) | 0x40
+			b[8] = (b[8] & 0x3f) | 0x80
+			return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+		},
+		"randInt": func(min, max int) (int, error) {
+			if max < min {
+				return 0, fmt.Errorf("randInt: %v is less than %v", max, min)
+			}
+			return min + rnd.Intn(max-min+1), nil
+		},
+		"randString": func(n int) string {
+			b := make([]byte, n)
+			for i := range b {
+				b[i] = randStringLetters[rnd.Intn(len(randStringLetters))]
+			}
+			return string(b)
+		},
+		"pick": func(items ...string) (string, error) {
+			if len(items) == 1 {
+				items = strings.Split(items[0], ",")
+			}
+			if len(items) == 0 {
+				return "", fmt.Errorf("pick: nothing to pick from")
+			}
+			return items[rnd.Intn(len(items))], nil
+		},
+		"now": time.Now,
+		"unixTime": func() int64 {
+			return time.Now().Unix()
+		},
+		"unixMilli": func() int64 {
+			return time.Now().UnixNano() / int64(time.Millisecond)
+		},
+		"rfc3339": func() string {
+			return time.Now().Format(time.RFC3339)
+		},
+		"base64": func(s string) string {
+			return base64.StdEncoding.EncodeToString([]byte(s))
+		},
+		"base64url": func(s string) string {
+			return base64.URLEncoding.EncodeToString([]byte(s))
+		},
+		"pathEscape":  url.PathEscape,
+		"queryEscape": url.QueryEscape,
+		"md5": func(s string) string {
+			h := md5.Sum([]byte(s))
+			return hex.EncodeToString(h[:])
+		},
+		"sha1": func(s string) string {
+			h := sha1.Sum([]byte(s))
+			return hex.EncodeToString(h[:])
+		},
+		"sha256": func(s string) string {
+			h := sha256.Sum256([]byte(s))
+			return hex.EncodeToString(h[:])
+		},
+		"hmac": func(key, msg string) string {
+			mac := hmac.New(sha256.New, []byte(key))
+			mac.Write([]byte(msg))
+			return hex.EncodeToString(mac.Sum(nil))
+		},
+	}
+}
+
+// The functions used by templates which do not belong to a task with a
+// seed.
+var defaultTemplateFuncs = newTemplateFuncs(time.Now().UnixNano())
+
+// newTemplate creates a template with a random name and the functions.
+func newTemplate(funcs template.FuncMap) *template.Template {
+	if funcs == nil {
+		funcs = defaultTemplateFuncs
+	}
+	return template.New(randomString()).Funcs(funcs)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"regexp"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func execTemplate(t *testing.T, funcs map[string]interface{}, text string) string {
+	tmpl, err := newTemplate(funcs).Parse(text)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	var out bytes.Buffer
+	err = tmpl.Execute(&out, map[string]string{"users": "alice,bob", "user": "monnand"})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	return out.String()
+}
+
+func TestTemplateFuncs(t *testing.T) {
+	funcs := newTemplateFuncs(1)
+	uuidPattern := regexp.MustCompile("^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$")
+	if u := execTemplate(t, funcs, "{{uuid}}"); !uuidPattern.MatchString(u) {
+		t.Errorf("%v is not a UUID", u)
+	}
+	for i := 0; i < 100; i++ {
+		n, err := strconv.Atoi(execTemplate(t, funcs, "{{randInt 3 5}}"))
+		if err != nil || n < 3 || n > 5 {
+			t.Fatalf("randInt returned %v: %v", n, err)
+		}
+	}
+	if s := execTemplate(t, funcs, "{{randString 12}}"); !regexp.MustCompile("^[a-zA-Z0-9]{12}$").MatchString(s) {
+		t.Errorf("Wrong random string: %v", s)
+	}
+	if s := execTemplate(t, funcs, "{{pick .users}}"); s != "alice" && s != "bob" {
+		t.Errorf("Wrong pick: %v", s)
+	}
+	if s := execTemplate(t, funcs, "{{pick `a` `b`}}"); s != "a" && s != "b" {
+		t.Errorf("Wrong pick: %v", s)
+	}
+
+	expected := map[string]string{
+		"{{base64 .user}}":        "bW9ubmFuZA==",
+		"{{base64url `a?b>`}}":    "YT9iPg==",
+		"{{queryEscape `a b&c`}}": "a+b%26c",
+		"{{pathEscape `a b/c`}}":  "a%20b%2Fc",
+		"{{md5 `abc`}}":           "900150983cd24fb0d6963f7d28e17f72",
+		"{{sha1 `abc`}}":          "a9993e364706816aba3e25717850c26c9cd0d89d",
+		"{{sha256 `abc`}}":        "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad",
+		"{{hmac `key` `The quick brown fox jumps over the lazy dog`}}": "f7bc83f430538424b13298e6aa6fb143ef4d59a14946175997479dbc2d1a3cd8",
+	}
+	for text, exp := range expected {
+		if s := execTemplate(t, funcs, text); s != exp {
+			t.Errorf("%v should be %v, not %v", text, exp, s)
+		}
+	}
+	if s := execTemplate(t, funcs, "{{unixTime}} {{unixMilli}} {{rfc3339}} {{now.Year}}"); len(s) == 0 {
+		t.Errorf("Empty time")
+	}
+}
+
+func TestTemplateFuncsInvalidArgs(t *testing.T) {
+	funcs := newTemplateFuncs(1)
+	for _, text := range []string{"{{randInt 5 3}}", "{{pick}}"} {
+		tmpl, err := newTemplate(funcs).Parse(text)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		var out bytes.Buffer
+		if err := tmpl.Execute(&out, nil); err == nil {
+			t.Errorf("%v should fail", text)
+		}
+	}
+}
+
+type urlRecorder struct {
+	urls []string
+	lock sync.Mutex
+	closer
+}
+
+func (self *urlRecorder) ReadResponse(req *Request, env *Env) (resp *Response, updates *Env, err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.urls = append(self.urls, req.FullURL())
+	resp = &Response{Status: 200}
+	return
+}
+
+func TestTaskSeedIsReproducible(t *testing.T) {
+	StartWorkers(1)
+	defer StopAllWorkers()
+
+	run := func(seed int64) []string {
+		taskSpec := genSingleActionTask()
+		spec := taskSpec.ConcurrentActions[0].Actions[0]
+		spec.URLTemplate = "http://localhost/{{uuid}}"
+		spec.URLQuery = map[string][]string{"n": []string{"{{randInt 1 1000000}}"}}
+		taskSpec.Seed = &seed
+		taskSpec.Load = &LoadSpec{Rate: 1000, Duration: "1s", MaxNrIterations: 5}
+		rr := new(urlRecorder)
+		runTask(t, taskSpec, rr)
+		return rr.urls
+	}
+	// With one worker, the requests are sent one by one, but the order of
+	// the iterations may differ, so compare the sets.
+	set := func(urls []string) map[string]bool {
+		ret := make(map[string]bool, len(urls))
+		for _, u := range urls {
+			ret[u] = true
+		}
+		return ret
+	}
+	a := set(run(42))
+	b := set(run(42))
+	c := set(run(43))
+	if len(a) != 5 {
+		t.Fatalf("Got %v different URLs, instead of 5: %v", len(a), a)
+	}
+	for u := range a {
+		if !b[u] {
+			t.Errorf("%v is not generated with the same seed", u)
+		}
+		if c[u] {
+			t.Errorf("%v is generated with a different seed", u)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/kr/pretty"
+)
+
+// ActionGraph is an alternative to the action sequence. Instead of waiting
+// for a whole step, an action starts as soon as the actions it depends on
+// have finished. The dependencies are named by their tags in DependsOn. An
+// action with several dependencies runs for each combination of the
+// environments they produce, and the actions without dependencies start
+// with the initial environment.
+//
+// Like a step, an action which produces no environment stops the actions
+// which depend on it, unless ProceedWhenNoUpdate is true, in which case
+// its own environments are passed on. The task returns the environments
+// produced by the actions no other action depends on.
+type ActionGraph struct {
+	Actions             []*ActionSpec `json:"actions"`
+	ProceedWhenNoUpdate bool          `json:"proceed-when-no-update,omitempty"`
+	Debug               bool          `json:"debug,omitempty"`
+}
+
+type actionNode struct {
+	// A step with the action alone, so that the action runs like any
+	// other step.
+	stage *ConcurrentActions
+	deps  []int
+	// Whether any other action depends on this one.
+	hasDependents bool
+}
+
+// getNodes checks the dependencies of the actions. Every action needs a
+// unique tag, and the dependencies cannot form a cycle.
+func (self *ActionGraph) getNodes() (nodes []*actionNode, err error) {
+	if len(self.Actions) == 0 {
+		err = fmt.Errorf("action graph has no action")
+		return
+	}
+	idx := make(map[string]int, len(self.Actions))
+	for i, spec := range self.Actions {
+		if len(spec.Tag) == 0 {
+			err = fmt.Errorf("every action in the action graph needs a tag")
+			return
+		}
+		if _, ok := idx[spec.Tag]; ok {
+			err = fmt.Errorf("action graph has more than one action tagged %v", spec.Tag)
+			return
+		}
+		idx[spec.Tag] = i
+	}
+	ret := make([]*actionNode, len(self.Actions))
+	for i, spec := range self.Actions {
+		node := new(actionNode)
+		node.stage = &ConcurrentActions{
+			Actions: []*ActionSpec{spec},
+			Debug:   self.Debug,
+		}
+		for _, tag := range spec.DependsOn {
+			dep, ok := idx[tag]
+			if !ok {
+				err = fmt.Errorf("Action %v depends on unknown action %v", spec.Tag, tag)
+				return
+			}
+			node.deps = append(node.deps, dep)
+		}
+		ret[i] = node
+	}
+
+	// Remove the actions whose dependencies are all removed, until
+	// nothing can be removed. Whatever is left is in a cycle.
+	nrDeps := make([]int, len(ret))
+	dependents := make([][]int, len(ret))
+	ready := make([]int, 0, len(ret))
+	for i, node := range ret {
+		nrDeps[i] = len(node.deps)
+		for _, dep := range node.deps {
+			dependents[dep] = append(dependents[dep], i)
+			ret[dep].hasDependents = true
+		}
+		if nrDeps[i] == 0 {
+			ready = append(ready, i)
+		}
+	}
+	nrRemoved := 0
+	for len(ready) > 0 {
+		i := ready[len(ready)-1]
+		ready = ready[:len(ready)-1]
+		nrRemoved++
+		for _, d := range dependents[i] {
+			nrDeps[d]--
+			if nrDeps[d] == 0 {
+				ready = append(ready, d)
+			}
+		}
+	}
+	if nrRemoved < len(ret) {
+		tags := make([]string, 0, len(ret)-nrRemoved)
+		for i, n := range nrDeps {
+			if n > 0 {
+				tags = append(tags, self.Actions[i].Tag)
+			}
+		}
+		err = fmt.Errorf("action graph has a cycle among %v", strings.Join(tags, ", "))
+		return
+	}
+	nodes = ret
+	return
+}
+
+// combineEnvs merges each environment in a with each one in b.
+func combineEnvs(a, b []*Env) []*Env {
+	ret := make([]*Env, 0, len(a)*len(b))
+	for _, x := range a {
+		for _, y := range b {
+			e := x.Clone()
+			e.Update(y)
+			ret = append(ret, e)
+		}
+	}
+	return uniqEnvs(ret...)
+}
+
+// executeGraph runs each action of the graph in its own goroutine, once the
+// actions it depends on are done.
+func (self *worker) executeGraph(it *iteration, env *Env, errChan chan<- error) []*Env {
+	nodes := it.scenario.nodes
+	outputs := make([][]*Env, len(nodes))
+	done := make([]chan struct{}, len(nodes))
+	for i := range done {
+		done[i] = make(chan struct{})
+	}
+	for i, node := range nodes {
+		go func(i int, node *actionNode) {
+			defer close(done[i])
+			inputs := []*Env{env}
+			for _, dep := range node.deps {
+				<-done[dep]
+				inputs = combineEnvs(inputs, outputs[dep])
+			}
+			if len(inputs) == 0 {
+				return
+			}
+			// Any time spent waiting for a free worker is part of the
+			// response time, but not the time spent waiting for the
+			// dependencies.
+			scheduled := time.Now()
+			if len(node.deps) == 0 && !it.start.IsZero() {
+				scheduled = it.start
+			}
+			if node.stage.Debug {
+				pretty.Printf("Action %v\n%v environments:%# v\n", node.stage.Actions[0].Tag, len(inputs), inputs)
+			}
+			forks := self.executeStage(node.stage, inputs, it, scheduled, errChan)
+			if len(forks) == 0 && it.scenario.graph.ProceedWhenNoUpdate {
+				forks = inputs
+			}
+			outputs[i] = forks
+		}(i, node)
+	}
+
+	var envs []*Env
+	for i, node := range nodes {
+		<-done[i]
+		if !node.hasDependents {
+			envs = append(envs, outputs[i]...)
+		}
+	}
+	return uniqEnvs(envs...)
+}
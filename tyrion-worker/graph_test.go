@@ -0,0 +1,158 @@
+package main
+
+import (
+	"io/ioutil"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// graphResponseReader responds with v=<last element of the path>, after a
+// delay for the paths in delays.
+type graphResponseReader struct {
+	delays map[string]time.Duration
+	lock   sync.Mutex
+	times  map[string]time.Time
+	urls   []string
+	closer
+}
+
+func (self *graphResponseReader) ReadResponse(req *Request, env *Env) (resp *Response, updates *Env, err error) {
+	name := path.Base(req.URL)
+	self.lock.Lock()
+	self.times[name] = time.Now()
+	self.urls = append(self.urls, req.URL)
+	self.lock.Unlock()
+	time.Sleep(self.delays[name])
+	resp = &Response{Status: 200, Body: ioutil.NopCloser(strings.NewReader("v=" + name))}
+	return
+}
+
+func graphAction(tag, url, capture string, deps ...string) *ActionSpec {
+	spec := &ActionSpec{
+		Tag:         tag,
+		URLTemplate: url,
+		Method:      "GET",
+		DependsOn:   deps,
+	}
+	if len(capture) > 0 {
+		spec.RespTemps = []string{`v=(?P<` + capture + `>\w+)`}
+	}
+	return spec
+}
+
+func TestActionGraph(t *testing.T) {
+	StartWorkers(8)
+	defer StopAllWorkers()
+
+	taskSpec := new(TaskSpec)
+	taskSpec.ActionGraph = &ActionGraph{
+		Actions: []*ActionSpec{
+			graphAction("join", "http://localhost/{{.slow}}/{{.fast}}/join", "joined", "slow", "fast"),
+			graphAction("login", "http://localhost/login", "token"),
+			graphAction("slow", "http://localhost/{{.token}}/slow", "slow", "login"),
+			graphAction("fast", "http://localhost/{{.token}}/fast", "fast", "login"),
+			graphAction("after-fast", "http://localhost/after", "after", "fast"),
+		},
+	}
+	rr := &graphResponseReader{
+		delays: map[string]time.Duration{"slow": 200 * time.Millisecond},
+		times:  make(map[string]time.Time),
+	}
+	envs := runTask(t, taskSpec, rr)
+
+	if len(rr.urls) != 5 {
+		t.Errorf("Got %v requests, instead of 5: %v", len(rr.urls), rr.urls)
+	}
+	for _, url := range []string{"http://localhost/login/slow", "http://localhost/login/fast", "http://localhost/slow/fast/join"} {
+		found := false
+		for _, u := range rr.urls {
+			found = found || u == url
+		}
+		if !found {
+			t.Errorf("%v is not requested: %v", url, rr.urls)
+		}
+	}
+	if d := rr.times["after"].Sub(rr.times["slow"]); d >= 100*time.Millisecond {
+		t.Errorf("after-fast should not wait for slow: %v", d)
+	}
+	if d := rr.times["join"].Sub(rr.times["slow"]); d < 200*time.Millisecond {
+		t.Errorf("join should wait for slow: %v", d)
+	}
+
+	// One environment from each of join and after-fast.
+	if len(envs) != 2 {
+		t.Fatalf("Got %v envs, instead of 2: %v", len(envs), envs)
+	}
+	for _, env := range envs {
+		if env.NameValuePairs["token"] != "login" || env.NameValuePairs["fast"] != "fast" {
+			t.Errorf("Wrong env: %v", env)
+		}
+		_, joined := env.NameValuePairs["joined"]
+		_, after := env.NameValuePairs["after"]
+		if joined == after {
+			t.Errorf("Wrong env: %v", env)
+		}
+	}
+}
+
+func TestActionGraphNoUpdate(t *testing.T) {
+	StartWorkers(4)
+	defer StopAllWorkers()
+
+	taskSpec := new(TaskSpec)
+	taskSpec.ActionGraph = &ActionGraph{
+		Actions: []*ActionSpec{
+			graphAction("ping", "http://localhost/ping", ""),
+			graphAction("next", "http://localhost/next", "next", "ping"),
+		},
+	}
+	rr := &graphResponseReader{times: make(map[string]time.Time)}
+	runTask(t, taskSpec, rr)
+	if len(rr.urls) != 1 {
+		t.Errorf("next should not run: %v", rr.urls)
+	}
+
+	taskSpec.ActionGraph.ProceedWhenNoUpdate = true
+	rr = &graphResponseReader{times: make(map[string]time.Time)}
+	envs := runTask(t, taskSpec, rr)
+	if len(rr.urls) != 2 {
+		t.Errorf("next should run: %v", rr.urls)
+	}
+	if len(envs) != 1 || envs[0].NameValuePairs["next"] != "next" {
+		t.Errorf("Wrong envs: %v", envs)
+	}
+}
+
+func TestInvalidActionGraphs(t *testing.T) {
+	graphs := [][]*ActionSpec{
+		nil,
+		{graphAction("", "http://localhost/a", "")},
+		{graphAction("a", "http://localhost/a", ""), graphAction("a", "http://localhost/b", "")},
+		{graphAction("a", "http://localhost/a", "", "b")},
+		{graphAction("a", "http://localhost/a", "", "a")},
+		{
+			graphAction("a", "http://localhost/a", ""),
+			graphAction("b", "http://localhost/b", "", "a", "d"),
+			graphAction("c", "http://localhost/c", "", "b"),
+			graphAction("d", "http://localhost/d", "", "c"),
+		},
+	}
+	for _, actions := range graphs {
+		taskSpec := new(TaskSpec)
+		taskSpec.ActionGraph = &ActionGraph{Actions: actions}
+		if _, err := taskSpec.GetWorker(new(graphResponseReader)); err == nil {
+			t.Errorf("Should be an error: %v", actions)
+		}
+	}
+
+	taskSpec := genSingleActionTask()
+	taskSpec.ActionGraph = &ActionGraph{
+		Actions: []*ActionSpec{graphAction("a", "http://localhost/a", "")},
+	}
+	if _, err := taskSpec.GetWorker(new(graphResponseReader)); err == nil {
+		t.Errorf("Should not use both action-seq and action-graph")
+	}
+}
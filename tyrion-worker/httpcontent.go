@@ -86,29 +86,110 @@ type MultiPartContentSpec struct {
 }
 
 // If RawContent is specified, others will be ignored.
+// Otherwise, if JSON is specified, it is sent as application/json.
 // Otherwise, if MultiPart is specified, Form will be ignored.
 // Otherwise, use Form or empty string.
+//
+// JSON can be any json value. Its strings are templates, whose outputs are
+// escaped properly.
 type HttpRequestContent struct {
 	RawContent string                `json:"raw-content,omitempty"`
+	JSON       interface{}           `json:"json,omitempty"`
 	MultiPart  *MultiPartContentSpec `json:"multipart,omitempty"`
 	Form       map[string][]string   `json:"form,omitempty"`
 }
 
+// UnmarshalJSON keeps the numbers of JSON as json.Number, so that they are
+// sent exactly as they are written.
+func (self *HttpRequestContent) UnmarshalJSON(data []byte) error {
+	type content HttpRequestContent
+	var c struct {
+		*content
+		JSON json.RawMessage `json:"json,omitempty"`
+	}
+	c.content = (*content)(self)
+	err := json.Unmarshal(data, &c)
+	if err != nil {
+		return err
+	}
+	self.JSON = nil
+	if len(c.JSON) == 0 {
+		return nil
+	}
+	d := json.NewDecoder(bytes.NewReader(c.JSON))
+	d.UseNumber()
+	return d.Decode(&self.JSON)
+}
+
 func (self *HttpRequestContent) Eq(b *HttpRequestContent) bool {
 	return reflect.DeepEqual(self, b)
 }
 
-func (self *HttpRequestContent) ToTemplate() (tmpl *template.Template, err error) {
-	js, err := json.Marshal(self)
+// ContentTemplate is an HttpRequestContent whose strings, including the
+// keys of the forms, are templates. Each string is templated separately.
+type ContentTemplate struct {
+	raw           *template.Template
+	json          *jsonTemplate
+	hasMultiPart  bool
+	multiPartForm *valuesTemplate
+	files         []*fileTemplate
+	form          *valuesTemplate
+}
+
+type fileTemplate struct {
+	field    *template.Template
+	filename *template.Template
+	content  *template.Template
+}
+
+func (self *HttpRequestContent) ToTemplate() (tmpl *ContentTemplate, err error) {
+	return self.toTemplate(nil)
+}
+
+func (self *HttpRequestContent) toTemplate(funcs template.FuncMap) (tmpl *ContentTemplate, err error) {
+	ret := new(ContentTemplate)
+	ret.raw, err = parseTemplate(self.RawContent, funcs, nil)
 	if err != nil {
-		err = fmt.Errorf("%+v is cannot be encoded into json: %v", self, err)
 		return
 	}
-	tmpl, err = template.New(randomString()).Parse(string(js))
+	if self.JSON != nil {
+		ret.json, err = newJSONTemplate(self.JSON, funcs)
+		if err != nil {
+			return
+		}
+	}
+	if self.MultiPart != nil {
+		ret.hasMultiPart = true
+		ret.multiPartForm, err = newValuesTemplate(self.MultiPart.Form, funcs, nil)
+		if err != nil {
+			return
+		}
+		for _, f := range self.MultiPart.Files {
+			if f == nil {
+				ret.files = append(ret.files, nil)
+				continue
+			}
+			ft := new(fileTemplate)
+			ft.field, err = parseTemplate(f.Field, funcs, nil)
+			if err != nil {
+				return
+			}
+			ft.filename, err = parseTemplate(f.Filename, funcs, nil)
+			if err != nil {
+				return
+			}
+			ft.content, err = parseTemplate(f.Content, funcs, nil)
+			if err != nil {
+				return
+			}
+			ret.files = append(ret.files, ft)
+		}
+	}
+	ret.form, err = newValuesTemplate(self.Form, funcs, nil)
 	if err != nil {
-		err = fmt.Errorf("%v is not a valid template: %v", string(js), err)
 		return
 	}
+	tmpl = ret
 	return
 }
 
@@ -128,6 +209,15 @@ func (self *HttpRequestContent) DecorateRequest(req *http.Request) error {
 		req.Body = ioutil.NopCloser(bytes.NewBufferString(self.RawContent))
 		return nil
 	}
+	if self.JSON != nil {
+		js, err := json.Marshal(self.JSON)
+		if err != nil {
+			return fmt.Errorf("JSON: cannot encode %v. %v", self.JSON, err)
+		}
+		req.Body = ioutil.NopCloser(bytes.NewBuffer(js))
+		req.Header.Set("Content-Type", "application/json")
+		return nil
+	}
 	if self.MultiPart != nil {
 		writer := multipart.NewWriter(body)
 		defer writer.Close()
@@ -159,21 +249,49 @@ func (self *HttpRequestContent) DecorateRequest(req *http.Request) error {
 	return nil
 }
 
-func NewContent(tmpl *template.Template, env *Env) (content *HttpRequestContent, err error) {
-	var out bytes.Buffer
+func NewContent(tmpl *ContentTemplate, env *Env) (content *HttpRequestContent, err error) {
 	if tmpl == nil {
 		return
 	}
-	if env == nil {
-		err = tmpl.Execute(&out, nil)
-	} else {
-		err = tmpl.Execute(&out, env.NameValuePairs)
-	}
+	ret := new(HttpRequestContent)
+	ret.RawContent, err = executeTemplate(tmpl.raw, env)
 	if err != nil {
 		return
 	}
-	ret := new(HttpRequestContent)
-	err = json.Unmarshal(out.Bytes(), ret)
+	if tmpl.json != nil {
+		ret.JSON, err = tmpl.json.execute(env)
+		if err != nil {
+			return
+		}
+	}
+	if tmpl.hasMultiPart {
+		ret.MultiPart = new(MultiPartContentSpec)
+		ret.MultiPart.Form, err = tmpl.multiPartForm.execute(env)
+		if err != nil {
+			return
+		}
+		for _, ft := range tmpl.files {
+			if ft == nil {
+				ret.MultiPart.Files = append(ret.MultiPart.Files, nil)
+				continue
+			}
+			f := new(MultiPartFileSpec)
+			f.Field, err = executeTemplate(ft.field, env)
+			if err != nil {
+				return
+			}
+			f.Filename, err = executeTemplate(ft.filename, env)
+			if err != nil {
+				return
+			}
+			f.Content, err = executeTemplate(ft.content, env)
+			if err != nil {
+				return
+			}
+			ret.MultiPart.Files = append(ret.MultiPart.Files, f)
+		}
+	}
+	ret.Form, err = tmpl.form.execute(env)
 	if err != nil {
 		return
 	}
@@ -1,7 +1,11 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
 	"testing"
 )
 
@@ -82,3 +86,119 @@ func TestHttpContentTemplateTransformWithVars(t *testing.T) {
 		t.Errorf("%+v != %+v", a, b)
 	}
 }
+
+func TestHttpContentJSON(t *testing.T) {
+	var body interface{}
+	err := json.Unmarshal([]byte(`{
+		"name": "{{.name}}",
+		"age": 42,
+		"admin": false,
+		"nick": null,
+		"tags": ["{{.tag}}", "static"],
+		"{{.name}}": {"quote": "say {{.quote}}"}
+	}`), &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	as := &ActionSpec{
+		URLTemplate: "http://localhost:8080/",
+		Method:      "POST",
+		Tag:         "sometag",
+		Content:     &HttpRequestContent{JSON: body},
+	}
+	action, err := as.GetAction(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := EmptyEnv()
+	env.NameValuePairs["name"] = `Nan "monnand" Deng`
+	env.NameValuePairs["tag"] = `a\b`
+	env.NameValuePairs["quote"] = `"}, "injected": {"`
+	content, err := action.getContent(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("POST", "http://localhost:8080/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = content.DecorateRequest(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ct := req.Header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Wrong content type: %v", ct)
+	}
+	d, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]interface{}
+	err = json.Unmarshal(d, &got)
+	if err != nil {
+		t.Fatalf("Invalid json %s: %v", d, err)
+	}
+	exp := map[string]interface{}{
+		"name":  `Nan "monnand" Deng`,
+		"age":   42.0,
+		"admin": false,
+		"nick":  nil,
+		"tags":  []interface{}{`a\b`, "static"},
+		"{{.name}}": map[string]interface{}{
+			"quote": `say "}, "injected": {"`,
+		},
+	}
+	if !reflect.DeepEqual(exp, got) {
+		t.Errorf("Got %v, instead of %v", got, exp)
+	}
+}
+
+func TestHttpContentJSONNumbers(t *testing.T) {
+	var as ActionSpec
+	err := json.Unmarshal([]byte(`{
+		"url": "http://localhost:8080/",
+		"method": "POST",
+		"tag": "sometag",
+		"content": {"json": {"id": 1234567890123456789, "price": 1.50, "ids": [9007199254740993]}}
+	}`), &as)
+	if err != nil {
+		t.Fatal(err)
+	}
+	action, err := as.GetAction(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := action.getContent(EmptyEnv())
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("POST", "http://localhost:8080/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = content.DecorateRequest(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := `{"id":1234567890123456789,"ids":[9007199254740993],"price":1.50}`
+	if string(d) != exp {
+		t.Errorf("Got %s, instead of %v", d, exp)
+	}
+}
+
+func TestHttpContentInvalidJSONTemplate(t *testing.T) {
+	as := &ActionSpec{
+		URLTemplate: "http://localhost:8080/",
+		Method:      "POST",
+		Tag:         "sometag",
+		Content:     &HttpRequestContent{JSON: []interface{}{"{{.name"}},
+	}
+	_, err := as.GetAction(nil)
+	if err == nil {
+		t.Error("Should be an error")
+	}
+}
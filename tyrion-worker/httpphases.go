@@ -0,0 +1,170 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// HttpPhases breaks the latency of an HTTP request down. A phase which did
+// not happen, e.g. the DNS lookup for a reused connection, is zero.
+// FirstByte is measured from when the request started.
+type HttpPhases struct {
+	DNSLookup    time.Duration
+	Connect      time.Duration
+	TLSHandshake time.Duration
+	FirstByte    time.Duration
+	Transfer     time.Duration
+	ConnReused   bool
+}
+
+// Env returns the phases as variables, in nanoseconds.
+func (self *HttpPhases) Env() *Env {
+	ret := EmptyEnv()
+	ret.NameValuePairs["trace_dns"] = fmt.Sprint(self.DNSLookup.Nanoseconds())
+	ret.NameValuePairs["trace_connect"] = fmt.Sprint(self.Connect.Nanoseconds())
+	ret.NameValuePairs["trace_tls"] = fmt.Sprint(self.TLSHandshake.Nanoseconds())
+	ret.NameValuePairs["trace_first_byte"] = fmt.Sprint(self.FirstByte.Nanoseconds())
+	ret.NameValuePairs["trace_transfer"] = fmt.Sprint(self.Transfer.Nanoseconds())
+	ret.NameValuePairs["trace_conn_reused"] = fmt.Sprint(self.ConnReused)
+	return ret
+}
+
+// httpTracer collects the time of the events of one request. The callbacks
+// may be called from different goroutines.
+type httpTracer struct {
+	lock      sync.Mutex
+	start     time.Time
+	dnsStart  time.Time
+	dnsDone   time.Time
+	connStart time.Time
+	connDone  time.Time
+	tlsStart  time.Time
+	tlsDone   time.Time
+	tlsFailed bool
+	gotConn   time.Time
+	firstByte time.Time
+	reused    bool
+}
+
+func newHttpTracer() *httpTracer {
+	ret := new(httpTracer)
+	ret.start = time.Now()
+	return ret
+}
+
+func (self *httpTracer) mark(t *time.Time) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	// Only keep the first one, e.g. the first attempt to connect.
+	if t.IsZero() {
+		*t = time.Now()
+	}
+}
+
+func (self *httpTracer) ClientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			self.mark(&self.dnsStart)
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			self.mark(&self.dnsDone)
+		},
+		ConnectStart: func(network, addr string) {
+			self.mark(&self.connStart)
+		},
+		ConnectDone: func(network, addr string, err error) {
+			self.mark(&self.connDone)
+		},
+		TLSHandshakeStart: func() {
+			self.mark(&self.tlsStart)
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			self.mark(&self.tlsDone)
+			if err != nil {
+				self.lock.Lock()
+				defer self.lock.Unlock()
+				self.tlsFailed = true
+			}
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			self.lock.Lock()
+			defer self.lock.Unlock()
+			self.reused = info.Reused
+			if self.gotConn.IsZero() {
+				self.gotConn = time.Now()
+			}
+		},
+		GotFirstResponseByte: func() {
+			self.mark(&self.firstByte)
+		},
+	}
+}
+
+func between(start, end time.Time) time.Duration {
+	if start.IsZero() || end.IsZero() {
+		return 0
+	}
+	return end.Sub(start)
+}
+
+// Phases returns the phases of the request, given the time when its body
+// was completely read.
+func (self *httpTracer) Phases(end time.Time) *HttpPhases {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	ret := new(HttpPhases)
+	ret.DNSLookup = between(self.dnsStart, self.dnsDone)
+	ret.Connect = between(self.connStart, self.connDone)
+	ret.TLSHandshake = between(self.tlsStart, self.tlsDone)
+	ret.FirstByte = between(self.start, self.firstByte)
+	ret.Transfer = between(self.firstByte, end)
+	ret.ConnReused = self.reused
+	return ret
+}
+
+// Phase returns the phase the request is in. It is one of dns, connect,
+// tls-handshake, response-header or body.
+func (self *httpTracer) Phase() string {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	switch {
+	case !self.dnsStart.IsZero() && self.dnsDone.IsZero():
+		return "dns"
+	case !self.tlsStart.IsZero() && (self.tlsDone.IsZero() || self.tlsFailed):
+		return "tls-handshake"
+	case self.gotConn.IsZero():
+		return "connect"
+	case self.firstByte.IsZero():
+		return "response-header"
+	}
+	return "body"
+}
+
+// TimeoutError is returned if a request times out. Phase is the phase the
+// request was in when it timed out. See httpTracer.Phase.
+type TimeoutError struct {
+	Phase string
+	Err   error
+}
+
+func (self *TimeoutError) Error() string {
+	return fmt.Sprintf("timeout in %v: %v", self.Phase, self.Err)
+}
+
+func (self *TimeoutError) Timeout() bool {
+	return true
+}
+
+func isTimeout(err error) bool {
+	if _, ok := err.(*TimeoutError); ok {
+		return true
+	}
+	if e, ok := err.(net.Error); ok {
+		return e.Timeout()
+	}
+	return false
+}
@@ -3,8 +3,13 @@ package main
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/http/httptrace"
+	"sync/atomic"
+	"time"
 )
 
 func init() {
@@ -30,13 +35,182 @@ func (self *HttpResponseReaderFactory) NewPlugin(params map[string]string, rest
 			convertError = false
 		}
 	}
-	rr = &HttpResponseReader{convertError: convertError}
+	trace := false
+	if str, ok := params["trace"]; ok {
+		if str == "true" {
+			trace = true
+		}
+	}
+	cookies, err := boolParam(params, "cookies", false)
+	if err != nil {
+		return
+	}
+	tlsInfo, err := boolParam(params, "tls-info", false)
+	if err != nil {
+		return
+	}
+	transport, timeout, err := newHttpTransport(params)
+	if err != nil {
+		return
+	}
+	rr = &HttpResponseReader{
+		convertError: convertError,
+		trace:        trace,
+		cookies:      cookies,
+		tlsInfo:      tlsInfo,
+		transport:    transport,
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   timeout,
+		},
+	}
+	return
+}
+
+// newHttpTransport creates the transport shared by all requests going
+// through one http plugin. It accepts the following parameters:
+//
+// - max-idle-conns-per-host: the number of idle connections kept for each
+// host. Defaults to 2.
+// - keep-alive: false to use a new connection for each request. Defaults to
+// true.
+// - idle-timeout: how long an idle connection is kept, e.g. 90s.
+// - disable-compression: true to not ask for gzip.
+// - timeout: the time limit for each request, including reading the body.
+// - connect-timeout: the time limit to establish a connection, including
+// the DNS lookup. Defaults to 30s.
+// - tls-handshake-timeout: the time limit of the TLS handshake. Defaults to
+// 10s.
+// - response-header-timeout: the time limit to receive the response
+// headers after the request is written.
+// - tls-*: see newTLSConfig.
+// - protocol: see httpProtocols.
+//
+// It returns the per-request timeout as well.
+func newHttpTransport(params map[string]string) (transport *http.Transport, timeout time.Duration, err error) {
+	transport = http.DefaultTransport.(*http.Transport).Clone()
+	connectTimeout, err := durationParam(params, "connect-timeout", 30*time.Second)
+	if err != nil {
+		return
+	}
+	dialer := &net.Dialer{
+		Timeout:   connectTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	transport.DialContext = dialer.DialContext
+	transport.TLSHandshakeTimeout, err = durationParam(params, "tls-handshake-timeout", transport.TLSHandshakeTimeout)
+	if err != nil {
+		return
+	}
+	transport.ResponseHeaderTimeout, err = durationParam(params, "response-header-timeout", 0)
+	if err != nil {
+		return
+	}
+	transport.TLSClientConfig, err = newTLSConfig(params)
+	if err != nil {
+		return
+	}
+	transport.Protocols, err = httpProtocols(params["protocol"])
+	if err != nil {
+		return
+	}
+	transport.MaxIdleConnsPerHost, err = intParam(params, "max-idle-conns-per-host", http.DefaultMaxIdleConnsPerHost)
+	if err != nil {
+		return
+	}
+	if transport.MaxIdleConnsPerHost > transport.MaxIdleConns {
+		transport.MaxIdleConns = transport.MaxIdleConnsPerHost
+	}
+	keepAlive, err := boolParam(params, "keep-alive", true)
+	if err != nil {
+		return
+	}
+	transport.DisableKeepAlives = !keepAlive
+	transport.IdleConnTimeout, err = durationParam(params, "idle-timeout", transport.IdleConnTimeout)
+	if err != nil {
+		return
+	}
+	transport.DisableCompression, err = boolParam(params, "disable-compression", false)
+	if err != nil {
+		return
+	}
+	timeout, err = durationParam(params, "timeout", 0)
 	return
 }
 
+// httpProtocols returns the protocols the transport may use:
+//
+// - auto: HTTP/2 if the server supports it over TLS, HTTP/1.1 otherwise.
+// This is the default.
+// - http/1.1: always HTTP/1.1.
+// - h2: always HTTP/2 over TLS. Requests to http:// URLs fail.
+// - h2c: always HTTP/2 over cleartext TCP, without upgrading from HTTP/1.1.
+func httpProtocols(name string) (protocols *http.Protocols, err error) {
+	p := new(http.Protocols)
+	switch name {
+	case "", "auto":
+		return
+	case "http/1.1":
+		p.SetHTTP1(true)
+	case "h2":
+		p.SetHTTP2(true)
+	case "h2c":
+		p.SetUnencryptedHTTP2(true)
+	default:
+		err = fmt.Errorf("unknown protocol: %v", name)
+		return
+	}
+	protocols = p
+	return
+}
+
+// If trace is true, the whole body is read by the plugin so that the
+// phases of the request can be measured. The phases are available in
+// Response.Phases and as variables in the updates. See HttpPhases.Env.
+//
+// If tlsInfo is true, the negotiated TLS version and cipher suite of HTTPS
+// requests are put in the updates as tls_version and tls_cipher_suite.
+//
+// If cookies is true, the cookie jar of the environment is used. After each
+// request, the cookies which would be sent to the same URL are put in the
+// updates as cookie_<name>.
+//
+// The body of the response is drained when it is closed, so that the
+// connection can be reused.
+//
+// A request which times out always fails with a *TimeoutError, even if
+// convert-error is true. Other errors are converted to a response with
+// status 500 if convert-error is true.
 type HttpResponseReader struct {
-	closer
 	convertError bool
+	trace        bool
+	cookies      bool
+	tlsInfo      bool
+	transport    *http.Transport
+	client       *http.Client
+}
+
+func (self *HttpResponseReader) Close() error {
+	if self.transport != nil {
+		self.transport.CloseIdleConnections()
+	}
+	return nil
+}
+
+func (self *HttpResponseReader) getClient(env *Env) *http.Client {
+	client := self.client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	if !self.cookies || env.CookieJar() == nil {
+		return client
+	}
+	// Clients are cheap. The connections are kept by the transport.
+	return &http.Client{
+		Transport: client.Transport,
+		Timeout:   client.Timeout,
+		Jar:       env.CookieJar(),
+	}
 }
 
 func (self *HttpResponseReader) ReadResponse(req *Request, env *Env) (resp *Response, updates *Env, err error) {
@@ -46,19 +220,29 @@ func (self *HttpResponseReader) ReadResponse(req *Request, env *Env) (resp *Resp
 		return
 	}
 	defer r.Body.Close()
+	sent := &countingReadCloser{ReadCloser: r.Body}
+	r.Body = sent
 	/*
 		d, _ := ioutil.ReadAll(r.Body)
 		fmt.Printf("\n******\n%v\n**********\n", string(d))
 		pretty.Printf("%# v\n", r.Header)
 		r.Body = ioutil.NopCloser(bytes.NewBuffer(d))
 	*/
-	client := &http.Client{}
+	// Always trace the request to know in which phase it timed out.
+	tracer := newHttpTracer()
+	r = r.WithContext(httptrace.WithClientTrace(r.Context(), tracer.ClientTrace()))
+	client := self.getClient(env)
 	httpResp, err = client.Do(r)
 	if err != nil {
+		if isTimeout(err) {
+			err = &TimeoutError{Phase: tracer.Phase(), Err: err}
+			return
+		}
 		if self.convertError {
 			resp = new(Response)
 			resp.Status = 500
 			resp.Body = ioutil.NopCloser(&bytes.Buffer{})
+			resp.BytesSent = sent.Count()
 			err = nil
 			return
 		}
@@ -66,15 +250,73 @@ func (self *HttpResponseReader) ReadResponse(req *Request, env *Env) (resp *Resp
 	}
 	resp = new(Response)
 	resp.Status = httpResp.StatusCode
-	resp.Body = httpResp.Body
-	/*
-		defer httpResp.Body.Close()
-		body, err := ioutil.ReadAll(httpResp.Body)
+	resp.Header = httpResp.Header
+	resp.Proto = httpResp.Proto
+	resp.Body = &drainingReadCloser{httpResp.Body}
+	resp.BytesSent = sent.Count()
+	if self.trace {
+		defer resp.Body.Close()
+		var body []byte
+		body, err = ioutil.ReadAll(resp.Body)
 		if err != nil {
+			resp = nil
 			return
 		}
 		resp.Body = ioutil.NopCloser(bytes.NewBuffer(body))
-	*/
+		resp.Phases = tracer.Phases(time.Now())
+		updates = resp.Phases.Env()
+	}
+	if self.tlsInfo && httpResp.TLS != nil {
+		if updates == nil {
+			updates = EmptyEnv()
+		}
+		updates.Update(tlsEnv(httpResp.TLS))
+	}
+	if client.Jar != nil {
+		if updates == nil {
+			updates = EmptyEnv()
+		}
+		updates.Update(cookieEnv(client.Jar, r.URL))
+	}
+	return
+}
+
+// countingReadCloser counts the bytes read from it. The transport may read
+// the request body in another goroutine.
+type countingReadCloser struct {
+	io.ReadCloser
+	n int64
+}
+
+func (self *countingReadCloser) Read(p []byte) (n int, err error) {
+	n, err = self.ReadCloser.Read(p)
+	atomic.AddInt64(&self.n, int64(n))
+	return
+}
+
+func (self *countingReadCloser) Count() int64 {
+	return atomic.LoadInt64(&self.n)
+}
+
+// Do not bother to drain a body larger than this. The connection will be
+// closed instead.
+const maxDrainSize = 1 << 20
 
+// drainingReadCloser also reports a timeout while reading the body as a
+// *TimeoutError.
+type drainingReadCloser struct {
+	io.ReadCloser
+}
+
+func (self *drainingReadCloser) Read(p []byte) (n int, err error) {
+	n, err = self.ReadCloser.Read(p)
+	if err != nil && isTimeout(err) {
+		err = &TimeoutError{Phase: "body", Err: err}
+	}
 	return
 }
+
+func (self *drainingReadCloser) Close() error {
+	io.Copy(ioutil.Discard, io.LimitReader(self.ReadCloser, maxDrainSize))
+	return self.ReadCloser.Close()
+}
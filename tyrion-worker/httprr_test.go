@@ -3,10 +3,13 @@ package main
 import (
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"sync"
 	"testing"
+	"time"
 )
 
 func testHttpResponseReader(t *testing.T, method, content string, params url.Values, headers http.Header) {
@@ -89,3 +92,323 @@ func TestHttpResponseReader(t *testing.T) {
 	testHttpResponseReader(t, "GET", "something", nil, headers)
 	testHttpResponseReader(t, "POST", "hello", nil, headers)
 }
+
+func TestHttpResponseReaderTrace(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "Hello, client")
+	}))
+	defer ts.Close()
+
+	factory := &HttpResponseReaderFactory{}
+	rr, err := factory.NewPlugin(map[string]string{"trace": "true"}, nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer rr.Close()
+	req := &Request{
+		Tag:    "test",
+		URL:    ts.URL,
+		Method: "GET",
+	}
+	resp, u, err := rr.ReadResponse(req, nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if resp.Phases == nil {
+		t.Fatalf("No phases")
+	}
+	if resp.Phases.Connect <= 0 || resp.Phases.FirstByte < resp.Phases.Connect {
+		t.Errorf("Wrong phases: %+v", resp.Phases)
+	}
+	d, err := ioutil.ReadAll(resp.Body)
+	if err != nil || string(d) != "Hello, client\n" {
+		t.Errorf("Body: %v; error: %v", string(d), err)
+	}
+	for _, k := range []string{"trace_dns", "trace_connect", "trace_tls", "trace_first_byte", "trace_transfer", "trace_conn_reused"} {
+		if _, ok := u.NameValuePairs[k]; !ok {
+			t.Errorf("%v is not in the updates: %v", k, u)
+		}
+	}
+}
+
+func TestHttpResponseReaderFullURL(t *testing.T) {
+	var lock sync.Mutex
+	var received []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		received = append(received, r.RequestURI)
+	}))
+	defer ts.Close()
+
+	factory := &HttpResponseReaderFactory{}
+	rr, err := factory.NewPlugin(map[string]string{}, nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer rr.Close()
+	reqs := []*Request{
+		&Request{URL: ts.URL + "/path?a=1"},
+		&Request{URL: ts.URL + "/path?a=1", URLQuery: url.Values{"b": []string{"2 3"}}},
+		&Request{URL: ts.URL + "/path", URLQuery: url.Values{"b": []string{"&"}}},
+	}
+	for i, req := range reqs {
+		req.Tag = "test"
+		req.Method = "GET"
+		resp, _, err := rr.ReadResponse(req, nil)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		resp.Body.Close()
+		if exp := ts.URL + received[i]; req.FullURL() != exp {
+			t.Errorf("Sent %v, but the full URL is %v", exp, req.FullURL())
+		}
+	}
+}
+
+// countChainConns sends n requests through the plugins and returns the
+// number of connections opened to the server.
+func countChainConns(t *testing.T, specs []*PluginSpec, handler http.HandlerFunc, n int) int {
+	var lock sync.Mutex
+	nrConns := 0
+	ts := httptest.NewUnstartedServer(handler)
+	ts.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			lock.Lock()
+			defer lock.Unlock()
+			nrConns++
+		}
+	}
+	ts.Start()
+	defer ts.Close()
+
+	rr, err := NewPluginChain(specs)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer rr.Close()
+	for i := 0; i < n; i++ {
+		req := &Request{
+			Tag:    "test",
+			URL:    ts.URL,
+			Method: "GET",
+		}
+		resp, _, err := rr.ReadResponse(req, nil)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		// Close without reading. The body should be drained.
+		resp.Body.Close()
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	return nrConns
+}
+
+func countNewConns(t *testing.T, params map[string]string, n int) int {
+	specs := []*PluginSpec{&PluginSpec{Name: "http", URLQuery: params}}
+	return countChainConns(t, specs, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "Hello, client")
+	}, n)
+}
+
+func TestHttpResponseReaderKeepAlive(t *testing.T) {
+	if n := countNewConns(t, map[string]string{}, 5); n != 1 {
+		t.Errorf("%v connections are used with keep-alive", n)
+	}
+	if n := countNewConns(t, map[string]string{"keep-alive": "false"}, 5); n != 5 {
+		t.Errorf("%v connections are used without keep-alive", n)
+	}
+}
+
+func TestRetryReusesConnections(t *testing.T) {
+	var lock sync.Mutex
+	nrReqs := 0
+	// Fails every other request.
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		nrReqs++
+		fail := nrReqs%2 == 1
+		lock.Unlock()
+		if fail {
+			w.WriteHeader(500)
+		}
+		fmt.Fprintln(w, "Hello, client")
+	}
+	specs := []*PluginSpec{
+		&PluginSpec{Name: "retry", URLQuery: map[string]string{"max-wait": "1ms", "retry-until": "200"}},
+		&PluginSpec{Name: "http"},
+	}
+	if n := countChainConns(t, specs, handler, 2); n != 1 {
+		t.Errorf("Retries should reuse the connection, but %v connections were made", n)
+	}
+	if nrReqs != 4 {
+		t.Errorf("Sent %v requests, instead of 4", nrReqs)
+	}
+}
+
+func TestHttpResponseReaderInvalidParams(t *testing.T) {
+	factory := &HttpResponseReaderFactory{}
+	params := []map[string]string{
+		{"keep-alive": "maybe"},
+		{"max-idle-conns-per-host": "many"},
+		{"idle-timeout": "forever"},
+		{"timeout": "10"},
+	}
+	for _, p := range params {
+		if _, err := factory.NewPlugin(p, nil); err == nil {
+			t.Errorf("%+v should be invalid", p)
+		}
+	}
+}
+
+func TestHttpResponseReaderTimeouts(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow-body" {
+			w.Write([]byte("Hello"))
+			w.(http.Flusher).Flush()
+		}
+		time.Sleep(500 * time.Millisecond)
+	}))
+	defer ts.Close()
+
+	factory := &HttpResponseReaderFactory{}
+	params := map[string]string{
+		"response-header-timeout": "50ms",
+		"timeout":                 "200ms",
+	}
+	rr, err := factory.NewPlugin(params, nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer rr.Close()
+
+	req := &Request{Tag: "test", URL: ts.URL + "/slow-header", Method: "GET"}
+	_, _, err = rr.ReadResponse(req, nil)
+	if te, ok := err.(*TimeoutError); !ok || te.Phase != "response-header" {
+		t.Errorf("Should be a timeout while waiting for the headers: %v", err)
+	}
+
+	req = &Request{Tag: "test", URL: ts.URL + "/slow-body", Method: "GET"}
+	resp, _, err := rr.ReadResponse(req, nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	_, err = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if te, ok := err.(*TimeoutError); !ok || te.Phase != "body" {
+		t.Errorf("Should be a timeout while reading the body: %v", err)
+	}
+	if o := getOutcome(resp, err); o != outcomeTimeout {
+		t.Errorf("Outcome should be timeout, not %v", o)
+	}
+}
+
+func readProto(t *testing.T, params map[string]string, url string) string {
+	factory := &HttpResponseReaderFactory{}
+	rr, err := factory.NewPlugin(params, nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer rr.Close()
+	req := &Request{Tag: "test", URL: url, Method: "GET"}
+	resp, _, err := rr.ReadResponse(req, nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer resp.Body.Close()
+	d, _ := ioutil.ReadAll(resp.Body)
+	if string(d) != resp.Proto {
+		t.Errorf("Server received %v, but the response is %v", string(d), resp.Proto)
+	}
+	return resp.Proto
+}
+
+func TestHttpResponseReaderProtocols(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Proto)
+	})
+	ts := httptest.NewUnstartedServer(handler)
+	ts.Config.Protocols = new(http.Protocols)
+	ts.Config.Protocols.SetHTTP1(true)
+	ts.Config.Protocols.SetUnencryptedHTTP2(true)
+	ts.Start()
+	defer ts.Close()
+
+	if p := readProto(t, map[string]string{}, ts.URL); p != "HTTP/1.1" {
+		t.Errorf("Should use HTTP/1.1 by default, not %v", p)
+	}
+	if p := readProto(t, map[string]string{"protocol": "h2c"}, ts.URL); p != "HTTP/2.0" {
+		t.Errorf("Should use h2c, not %v", p)
+	}
+
+	tlsServer := httptest.NewUnstartedServer(handler)
+	tlsServer.EnableHTTP2 = true
+	tlsServer.StartTLS()
+	defer tlsServer.Close()
+
+	params := map[string]string{"tls-insecure-skip-verify": "true"}
+	if p := readProto(t, params, tlsServer.URL); p != "HTTP/2.0" {
+		t.Errorf("Should use HTTP/2 over TLS by default, not %v", p)
+	}
+	params["protocol"] = "http/1.1"
+	if p := readProto(t, params, tlsServer.URL); p != "HTTP/1.1" {
+		t.Errorf("Should use HTTP/1.1, not %v", p)
+	}
+	params["protocol"] = "h2"
+	if p := readProto(t, params, tlsServer.URL); p != "HTTP/2.0" {
+		t.Errorf("Should use HTTP/2, not %v", p)
+	}
+
+	factory := &HttpResponseReaderFactory{}
+	if _, err := factory.NewPlugin(map[string]string{"protocol": "spdy"}, nil); err == nil {
+		t.Errorf("spdy should be an unknown protocol")
+	}
+}
+
+func TestHttpResponseReaderCookies(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/login" {
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "monnand", Path: "/"})
+			return
+		}
+		if c, err := r.Cookie("session"); err == nil {
+			fmt.Fprint(w, c.Value)
+		}
+	}))
+	defer ts.Close()
+
+	factory := &HttpResponseReaderFactory{}
+	rr, err := factory.NewPlugin(map[string]string{"cookies": "true"}, nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer rr.Close()
+
+	env := EmptyEnv()
+	resp, u, err := rr.ReadResponse(&Request{Tag: "login", URL: ts.URL + "/login", Method: "POST"}, env)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	resp.Body.Close()
+	if u.NameValuePairs["cookie_session"] != "monnand" {
+		t.Errorf("Cookie should be in the updates: %v", u)
+	}
+
+	whoami := func(env *Env) string {
+		resp, _, err := rr.ReadResponse(&Request{Tag: "whoami", URL: ts.URL + "/whoami", Method: "GET"}, env)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		defer resp.Body.Close()
+		d, _ := ioutil.ReadAll(resp.Body)
+		return string(d)
+	}
+	forks := env.Fork(u)
+	if user := whoami(forks[0]); user != "monnand" {
+		t.Errorf("The fork should send the cookie. Got %v", user)
+	}
+	if user := whoami(EmptyEnv()); user != "" {
+		t.Errorf("A new environment should not send the cookie. Got %v", user)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func tlsVersionName(v uint16) string {
+	for name, version := range tlsVersions {
+		if version == v {
+			return name
+		}
+	}
+	return fmt.Sprintf("0x%04x", v)
+}
+
+// newTLSConfig creates the TLS configuration of the http plugin from the
+// following parameters:
+//
+// - tls-cert, tls-key: the PEM files of the client certificate and its key.
+// - tls-ca: the PEM file of the CAs used to verify the servers. The system
+// CAs are used if it is not given.
+// - tls-server-name: the server name used in SNI and to verify the server.
+// - tls-min-version: the minimum TLS version, one of 1.0, 1.1, 1.2 and 1.3.
+// - tls-insecure-skip-verify: true to not verify the servers at all.
+//
+// It returns nil if none of them is given.
+func newTLSConfig(params map[string]string) (config *tls.Config, err error) {
+	ret := new(tls.Config)
+	given := false
+
+	certFile := params["tls-cert"]
+	keyFile := params["tls-key"]
+	if len(certFile) > 0 || len(keyFile) > 0 {
+		if len(certFile) == 0 || len(keyFile) == 0 {
+			err = fmt.Errorf("tls-cert and tls-key should be given together")
+			return
+		}
+		var cert tls.Certificate
+		cert, err = tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			err = fmt.Errorf("unable to load the client certificate: %v", err)
+			return
+		}
+		ret.Certificates = []tls.Certificate{cert}
+		given = true
+	}
+	if caFile, ok := params["tls-ca"]; ok {
+		var pem []byte
+		pem, err = ioutil.ReadFile(caFile)
+		if err != nil {
+			err = fmt.Errorf("unable to read the CA file: %v", err)
+			return
+		}
+		ret.RootCAs = x509.NewCertPool()
+		if !ret.RootCAs.AppendCertsFromPEM(pem) {
+			err = fmt.Errorf("no certificate found in %v", caFile)
+			return
+		}
+		given = true
+	}
+	if name, ok := params["tls-server-name"]; ok {
+		ret.ServerName = name
+		given = true
+	}
+	if v, ok := params["tls-min-version"]; ok {
+		if ret.MinVersion, ok = tlsVersions[v]; !ok {
+			err = fmt.Errorf("unknown TLS version: %v", v)
+			return
+		}
+		given = true
+	}
+	ret.InsecureSkipVerify, err = boolParam(params, "tls-insecure-skip-verify", false)
+	if err != nil {
+		return
+	}
+	if ret.InsecureSkipVerify {
+		given = true
+	}
+	if given {
+		config = ret
+	}
+	return
+}
+
+// tlsEnv returns the negotiated TLS version and cipher suite as variables.
+func tlsEnv(state *tls.ConnectionState) *Env {
+	ret := EmptyEnv()
+	ret.NameValuePairs["tls_version"] = tlsVersionName(state.Version)
+	ret.NameValuePairs["tls_cipher_suite"] = tls.CipherSuiteName(state.CipherSuite)
+	return ret
+}
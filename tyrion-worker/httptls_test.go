@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writePem(t *testing.T, filename, typ string, data []byte) {
+	f, err := os.Create(filename)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer f.Close()
+	err = pem.Encode(f, &pem.Block{Type: typ, Bytes: data})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+}
+
+// writeClientCert writes a self-signed certificate and its key.
+func writeClientCert(t *testing.T, dir string) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "tyrion"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	keyData, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	certFile = filepath.Join(dir, "client.pem")
+	keyFile = filepath.Join(dir, "client.key")
+	writePem(t, certFile, "CERTIFICATE", cert)
+	writePem(t, keyFile, "EC PRIVATE KEY", keyData)
+	return
+}
+
+func TestHttpResponseReaderMutualTLS(t *testing.T) {
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) == 0 {
+			w.WriteHeader(403)
+			return
+		}
+		fmt.Fprint(w, r.TLS.PeerCertificates[0].Subject.CommonName)
+	}))
+	ts.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	ts.StartTLS()
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "tyrion-tls")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeClientCert(t, dir)
+	caFile := filepath.Join(dir, "ca.pem")
+	writePem(t, caFile, "CERTIFICATE", ts.Certificate().Raw)
+
+	factory := &HttpResponseReaderFactory{}
+	params := map[string]string{
+		"tls-cert":        certFile,
+		"tls-key":         keyFile,
+		"tls-ca":          caFile,
+		"tls-server-name": "example.com",
+		"tls-min-version": "1.3",
+		"tls-info":        "true",
+	}
+	rr, err := factory.NewPlugin(params, nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer rr.Close()
+	req := &Request{Tag: "test", URL: ts.URL, Method: "GET"}
+	resp, u, err := rr.ReadResponse(req, nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	d, _ := ioutil.ReadAll(resp.Body)
+	if resp.Status != 200 || string(d) != "tyrion" {
+		t.Errorf("Status %v: %v", resp.Status, string(d))
+	}
+	if u.NameValuePairs["tls_version"] != "1.3" || len(u.NameValuePairs["tls_cipher_suite"]) == 0 {
+		t.Errorf("Wrong updates: %v", u)
+	}
+
+	// The TLS variables are only given if they are asked for.
+	delete(params, "tls-info")
+	rr, err = factory.NewPlugin(params, nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer rr.Close()
+	_, u, err = rr.ReadResponse(req, nil)
+	if err != nil || u != nil {
+		t.Errorf("Should not update the environment: %v, %v", u, err)
+	}
+
+	// Without the CA, the server cannot be verified.
+	delete(params, "tls-ca")
+	rr, err = factory.NewPlugin(params, nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer rr.Close()
+	resp, _, err = rr.ReadResponse(req, nil)
+	if err != nil || resp.Status != 500 {
+		t.Errorf("Should fail to verify the server")
+	}
+
+	// Unless it is not verified at all.
+	params["tls-insecure-skip-verify"] = "true"
+	rr, err = factory.NewPlugin(params, nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer rr.Close()
+	resp, _, err = rr.ReadResponse(req, nil)
+	if err != nil || resp.Status != 200 {
+		t.Errorf("Should skip the verification: %v", err)
+	}
+}
+
+func TestInvalidTLSParams(t *testing.T) {
+	params := []map[string]string{
+		{"tls-cert": "client.pem"},
+		{"tls-cert": "/nonexist/client.pem", "tls-key": "/nonexist/client.key"},
+		{"tls-ca": "/nonexist/ca.pem"},
+		{"tls-min-version": "2.0"},
+		{"tls-insecure-skip-verify": "sure"},
+	}
+	for _, p := range params {
+		if _, err := newTLSConfig(p); err == nil {
+			t.Errorf("%+v should be invalid", p)
+		}
+	}
+	if c, err := newTLSConfig(map[string]string{}); c != nil || err != nil {
+		t.Errorf("Should not have a TLS config")
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"text/template"
+)
+
+// jsonTemplate is a json value whose strings are templates. The templates
+// are executed separately and their outputs are put back as strings, so
+// the variables never need to be escaped.
+type jsonTemplate struct {
+	tmpl    *template.Template
+	object  map[string]*jsonTemplate
+	array   []*jsonTemplate
+	literal interface{}
+}
+
+// newJSONTemplate parses the strings in a value decoded from json. Keys of
+// objects are not templates.
+func newJSONTemplate(v interface{}, funcs template.FuncMap) (tmpl *jsonTemplate, err error) {
+	ret := new(jsonTemplate)
+	switch x := v.(type) {
+	case string:
+		ret.tmpl, err = parseTemplate(x, funcs, nil)
+		if err != nil {
+			return
+		}
+	case map[string]interface{}:
+		ret.object = make(map[string]*jsonTemplate, len(x))
+		for k, e := range x {
+			ret.object[k], err = newJSONTemplate(e, funcs)
+			if err != nil {
+				return
+			}
+		}
+	case []interface{}:
+		ret.array = make([]*jsonTemplate, len(x))
+		for i, e := range x {
+			ret.array[i], err = newJSONTemplate(e, funcs)
+			if err != nil {
+				return
+			}
+		}
+	default:
+		ret.literal = v
+	}
+	tmpl = ret
+	return
+}
+
+func (self *jsonTemplate) execute(env *Env) (v interface{}, err error) {
+	switch {
+	case self.tmpl != nil:
+		v, err = executeTemplate(self.tmpl, env)
+	case self.object != nil:
+		obj := make(map[string]interface{}, len(self.object))
+		for k, e := range self.object {
+			obj[k], err = e.execute(env)
+			if err != nil {
+				return
+			}
+		}
+		v = obj
+	case self.array != nil:
+		array := make([]interface{}, len(self.array))
+		for i, e := range self.array {
+			array[i], err = e.execute(env)
+			if err != nil {
+				return
+			}
+		}
+		v = array
+	default:
+		v = self.literal
+	}
+	return
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/PaesslerAG/jsonpath"
+)
+
+// jsonExtractor stores the value found by a JSONPath expression into a
+// variable.
+type jsonExtractor struct {
+	name string
+	path string
+	eval func(c context.Context, v interface{}) (interface{}, error)
+}
+
+// newJSONExtractors compiles a map from variable names to JSONPath
+// expressions. The extractors are sorted by the variable names.
+func newJSONExtractors(paths map[string]string) (extractors []*jsonExtractor, err error) {
+	extractors = make([]*jsonExtractor, 0, len(paths))
+	for name, path := range paths {
+		if len(name) == 0 {
+			err = fmt.Errorf("JSONPath %v needs a variable name", path)
+			return
+		}
+		e := new(jsonExtractor)
+		e.name = name
+		e.path = path
+		e.eval, err = jsonpath.New(path)
+		if err != nil {
+			err = fmt.Errorf("%v is not a valid JSONPath: %v", path, err)
+			return
+		}
+		extractors = append(extractors, e)
+	}
+	sort.Slice(extractors, func(i, j int) bool {
+		return extractors[i].name < extractors[j].name
+	})
+	return
+}
+
+// jsonValueString converts a value decoded from json into the string stored
+// in a variable. Objects and arrays are stored in json.
+func jsonValueString(v interface{}) string {
+	switch x := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return x
+	case float64:
+		return strconv.FormatFloat(x, 'f', -1, 64)
+	case json.Number:
+		return x.String()
+	case bool:
+		return strconv.FormatBool(x)
+	}
+	d, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprintf("%v", v)
+	}
+	return string(d)
+}
+
+// maxExactInt is the largest integer up to which a float64 holds every
+// integer exactly.
+const maxExactInt = 1 << 53
+
+// decodeJSON decodes a json document. Integers which a float64 cannot hold
+// exactly, e.g. large IDs, are kept as json.Number so that no digit is
+// lost. Other numbers are float64, which is what JSONPath filters compare
+// against.
+func decodeJSON(data []byte) (doc interface{}, err error) {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	err = d.Decode(&doc)
+	if err != nil {
+		return
+	}
+	if _, e := d.Token(); e != io.EOF {
+		err = fmt.Errorf("invalid data after the top-level value")
+		return
+	}
+	doc = exactNumbers(doc)
+	return
+}
+
+// exactNumbers replaces the json.Numbers in v by float64 where it does not
+// lose any digit.
+func exactNumbers(v interface{}) interface{} {
+	switch x := v.(type) {
+	case json.Number:
+		if i, err := x.Int64(); err == nil && i >= -maxExactInt && i <= maxExactInt {
+			return float64(i)
+		}
+		// Fractions are approximated by float64 anyway.
+		if strings.ContainsAny(x.String(), ".eE") {
+			if f, err := x.Float64(); err == nil {
+				return f
+			}
+		}
+		return x
+	case map[string]interface{}:
+		for k, e := range x {
+			x[k] = exactNumbers(e)
+		}
+	case []interface{}:
+		for i, e := range x {
+			x[i] = exactNumbers(e)
+		}
+	}
+	return v
+}
+
+// extractJSON applies the extractors to the body and returns one
+// environment per fork. A JSONPath which results in an array produces one
+// value per fork, see zipValues. Expressions which do not match anything
+// are ignored.
+func extractJSON(extractors []*jsonExtractor, body []byte) (envs []*Env, err error) {
+	if len(extractors) == 0 {
+		return
+	}
+	doc, err := decodeJSON(body)
+	if err != nil {
+		err = fmt.Errorf("response is not valid json: %v", err)
+		return
+	}
+	values := make(map[string][]string, len(extractors))
+	scalars := make(map[string]string, len(extractors))
+	for _, e := range extractors {
+		v, e2 := e.eval(context.Background(), doc)
+		if e2 != nil {
+			// Unknown keys, out of range indices etc.
+			continue
+		}
+		if vs, ok := v.([]interface{}); ok {
+			strs := make([]string, len(vs))
+			for i, x := range vs {
+				strs[i] = jsonValueString(x)
+			}
+			values[e.name] = strs
+			continue
+		}
+		scalars[e.name] = jsonValueString(v)
+	}
+	envs = zipValues(values, scalars)
+	return
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+const usersJSON = `{
+	"total": 2,
+	"users": [
+		{"id": 1, "name": "Nan", "admin": true},
+		{"id": 2, "name": "Alan", "admin": false}
+	]
+}`
+
+func TestPerformActionJSONForks(t *testing.T) {
+	as := &ActionSpec{
+		RespJSON: map[string]string{
+			"id":    "$.users[*].id",
+			"name":  "$.users[*].name",
+			"total": "$.total",
+		},
+	}
+	updates, err := performActionOnBody(t, as, usersJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := []map[string]string{
+		{"id": "1", "name": "Nan", "total": "2"},
+		{"id": "2", "name": "Alan", "total": "2"},
+	}
+	if len(updates) != len(exp) {
+		t.Fatalf("Got %v updates, instead of %v", len(updates), len(exp))
+	}
+	for i, u := range updates {
+		if !stringMapEq(exp[i], u.NameValuePairs) {
+			t.Errorf("updates[%v] should be %v, not %v", i, exp[i], u.NameValuePairs)
+		}
+	}
+}
+
+func TestPerformActionJSONMaxNrForks(t *testing.T) {
+	as := &ActionSpec{
+		RespJSON:   map[string]string{"id": "$.users[*].id"},
+		MaxNrForks: 1,
+	}
+	updates, err := performActionOnBody(t, as, usersJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(updates) != 1 {
+		t.Fatalf("Got %v updates, instead of 1", len(updates))
+	}
+	if id := updates[0].NameValuePairs["id"]; id != "1" && id != "2" {
+		t.Errorf("Unexpected id: %v", id)
+	}
+}
+
+func TestPerformActionJSONWithTemplates(t *testing.T) {
+	as := &ActionSpec{
+		RespTemps: []string{`"name": "(?P<name>[a-zA-Z]+)"`},
+		RespJSON:  map[string]string{"total": "$.total"},
+	}
+	updates, err := performActionOnBody(t, as, usersJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(updates) != 2 {
+		t.Fatalf("Got %v updates, instead of 2", len(updates))
+	}
+	for _, u := range updates {
+		if u.NameValuePairs["total"] != "2" || len(u.NameValuePairs["name"]) == 0 {
+			t.Errorf("Unexpected update: %v", u)
+		}
+	}
+}
+
+func TestPerformActionJSONMustMatch(t *testing.T) {
+	as := &ActionSpec{
+		RespJSON:  map[string]string{"id": "$.missing"},
+		MustMatch: true,
+	}
+	_, err := performActionOnBody(t, as, usersJSON)
+	if err == nil {
+		t.Error("Should be an error")
+	}
+
+	as = &ActionSpec{
+		RespJSON:  map[string]string{"id": "$.id"},
+		MustMatch: true,
+	}
+	_, err = performActionOnBody(t, as, "not json")
+	if err == nil {
+		t.Error("Should be an error")
+	}
+
+	as = &ActionSpec{
+		RespJSON: map[string]string{"id": "$.id"},
+	}
+	updates, err := performActionOnBody(t, as, "not json")
+	if err != nil {
+		t.Error(err)
+	}
+	if len(updates) != 0 {
+		t.Errorf("Should not have updates: %v", updates)
+	}
+}
+
+func TestPerformActionJSONLargeNumbers(t *testing.T) {
+	as := &ActionSpec{
+		RespJSON: map[string]string{
+			"id":     "$.id",
+			"big":    "$.big",
+			"owner":  "$.owner",
+			"amount": "$.items[?(@.count == 2)].amount",
+		},
+	}
+	body := `{
+		"id": 1234567890123456789,
+		"big": 123456789012345678901234567890,
+		"owner": {"id": 9007199254740993},
+		"items": [{"count": 2, "amount": 1.25}, {"count": 3, "amount": 1e3}]
+	}`
+	updates, err := performActionOnBody(t, as, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := map[string]string{
+		"id":     "1234567890123456789",
+		"big":    "123456789012345678901234567890",
+		"owner":  `{"id":9007199254740993}`,
+		"amount": "1.25",
+	}
+	if len(updates) != 1 || !stringMapEq(exp, updates[0].NameValuePairs) {
+		t.Errorf("Wrong updates: %v", updates)
+	}
+}
+
+func TestJSONValueString(t *testing.T) {
+	values := map[string]interface{}{
+		"":                    nil,
+		"str":                 "str",
+		"1.5":                 1.5,
+		"100000000":           float64(100000000),
+		"true":                true,
+		"1234567890123456789": json.Number("1234567890123456789"),
+		`{"a":1}`:             map[string]interface{}{"a": 1.0},
+		`["a","b"]`:           []interface{}{"a", "b"},
+	}
+	for exp, v := range values {
+		if s := jsonValueString(v); s != exp {
+			t.Errorf("%v should be %v, not %v", v, exp, s)
+		}
+	}
+}
+
+func TestInvalidJSONPath(t *testing.T) {
+	as := &ActionSpec{
+		URLTemplate: "http://localhost:8080/",
+		Method:      "GET",
+		Tag:         "sometag",
+		RespJSON:    map[string]string{"id": "$.[[["},
+	}
+	_, err := as.GetAction(nil)
+	if err == nil {
+		t.Error("Should be an error")
+	}
+}
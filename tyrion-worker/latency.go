@@ -0,0 +1,206 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/HdrHistogram/hdrhistogram-go"
+)
+
+// Latencies are recorded in nanoseconds with three significant digits.
+// Anything longer than an hour is recorded as an hour.
+const (
+	minTrackedLatency = int64(time.Microsecond)
+	maxTrackedLatency = int64(time.Hour)
+)
+
+// LatencySummarizer is implemented by response readers which aggregate the
+// latencies of the requests going through them.
+type LatencySummarizer interface {
+	LatencySummaries() []*LatencySummary
+}
+
+// All latencies are in nanoseconds.
+type LatencyPercentiles struct {
+	Min  int64   `json:"min"`
+	Mean float64 `json:"mean"`
+	P50  int64   `json:"p50"`
+	P90  int64   `json:"p90"`
+	P99  int64   `json:"p99"`
+	P999 int64   `json:"p99.9"`
+	Max  int64   `json:"max"`
+}
+
+// LatencySummary summarizes the requests with the same tag in the same
+// scenario. Tag is the tag of the action before it is executed. Scenario is
+// empty if the task has no scenarios. Count includes the failed requests,
+// whose number is given by Errors. Timeouts are counted in Errors as well.
+// AssertionFailures counts the responses which were received but failed the
+// assertions of the action. They are not counted in Errors.
+type LatencySummary struct {
+	Scenario          string              `json:"scenario,omitempty"`
+	Tag               string              `json:"tag"`
+	Count             int64               `json:"count"`
+	Errors            int64               `json:"errors"`
+	Timeouts          int64               `json:"timeouts"`
+	AssertionFailures int64               `json:"assertion-failures"`
+	ServiceTime       *LatencyPercentiles `json:"service-time"`
+	ResponseTime      *LatencyPercentiles `json:"response-time"`
+}
+
+func newLatencyHistogram() *hdrhistogram.Histogram {
+	return hdrhistogram.New(minTrackedLatency, maxTrackedLatency, 3)
+}
+
+func recordLatency(h *hdrhistogram.Histogram, d time.Duration) {
+	v := int64(d)
+	if v > maxTrackedLatency {
+		v = maxTrackedLatency
+	}
+	if v < 0 {
+		v = 0
+	}
+	h.RecordValue(v)
+}
+
+func getPercentiles(h *hdrhistogram.Histogram) *LatencyPercentiles {
+	ret := new(LatencyPercentiles)
+	if h.TotalCount() == 0 {
+		return ret
+	}
+	ret.Min = h.Min()
+	ret.Mean = h.Mean()
+	ret.P50 = h.ValueAtQuantile(50)
+	ret.P90 = h.ValueAtQuantile(90)
+	ret.P99 = h.ValueAtQuantile(99)
+	ret.P999 = h.ValueAtQuantile(99.9)
+	ret.Max = h.Max()
+	return ret
+}
+
+type tagLatency struct {
+	count             int64
+	errors            int64
+	timeouts          int64
+	assertionFailures int64
+	serviceTime       *hdrhistogram.Histogram
+	responseTime      *hdrhistogram.Histogram
+}
+
+type latencyKey struct {
+	scenario string
+	tag      string
+}
+
+// latencyRecorder keeps one pair of histograms for each tag in each
+// scenario. It is safe to be used concurrently.
+type latencyRecorder struct {
+	tags map[latencyKey]*tagLatency
+	lock sync.Mutex
+}
+
+func newLatencyRecorder() *latencyRecorder {
+	ret := new(latencyRecorder)
+	ret.tags = make(map[latencyKey]*tagLatency, 10)
+	return ret
+}
+
+func (self *latencyRecorder) get(scenario, tag string) *tagLatency {
+	key := latencyKey{scenario: scenario, tag: tag}
+	l, ok := self.tags[key]
+	if !ok {
+		l = new(tagLatency)
+		l.serviceTime = newLatencyHistogram()
+		l.responseTime = newLatencyHistogram()
+		self.tags[key] = l
+	}
+	return l
+}
+
+// The outcomes of a request.
+const (
+	outcomeOK      = "ok"
+	outcomeError   = "error"
+	outcomeTimeout = "timeout"
+)
+
+// getOutcome tells whether a request succeeded. A response with a status of
+// 400 or above is an error.
+func getOutcome(resp *Response, err error) string {
+	if err != nil {
+		if isTimeout(err) {
+			return outcomeTimeout
+		}
+		return outcomeError
+	}
+	if resp == nil || resp.Status >= 400 {
+		return outcomeError
+	}
+	return outcomeOK
+}
+
+// record adds one request with the given tag in the scenario. The latencies
+// are only recorded if a response was received.
+func (self *latencyRecorder) record(scenario, tag string, resp *Response, err error, serviceTime, responseTime time.Duration) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	l := self.get(scenario, tag)
+	l.count++
+	switch getOutcome(resp, err) {
+	case outcomeTimeout:
+		l.timeouts++
+		l.errors++
+	case outcomeError:
+		l.errors++
+	}
+	if resp != nil {
+		recordLatency(l.serviceTime, serviceTime)
+		recordLatency(l.responseTime, responseTime)
+	}
+}
+
+// recordAssertionFailure counts a response with the given tag in the
+// scenario which failed the assertions.
+func (self *latencyRecorder) recordAssertionFailure(scenario, tag string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.get(scenario, tag).assertionFailures++
+}
+
+func (self *latencyRecorder) summaries() []*LatencySummary {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	ret := make([]*LatencySummary, 0, len(self.tags))
+	for key, l := range self.tags {
+		s := new(LatencySummary)
+		s.Scenario = key.scenario
+		s.Tag = key.tag
+		s.Count = l.count
+		s.Errors = l.errors
+		s.Timeouts = l.timeouts
+		s.AssertionFailures = l.assertionFailures
+		s.ServiceTime = getPercentiles(l.serviceTime)
+		s.ResponseTime = getPercentiles(l.responseTime)
+		ret = append(ret, s)
+	}
+	sort.Sort(latencySummariesByTag(ret))
+	return ret
+}
+
+type latencySummariesByTag []*LatencySummary
+
+func (self latencySummariesByTag) Len() int {
+	return len(self)
+}
+
+func (self latencySummariesByTag) Less(i, j int) bool {
+	if self[i].Scenario != self[j].Scenario {
+		return self[i].Scenario < self[j].Scenario
+	}
+	return self[i].Tag < self[j].Tag
+}
+
+func (self latencySummariesByTag) Swap(i, j int) {
+	self[i], self[j] = self[j], self[i]
+}
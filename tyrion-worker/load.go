@@ -0,0 +1,345 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// LoadSpec describes an open-model load: new task iterations are started
+// at the configured arrival rate for the given duration, no matter how long
+// each iteration takes to finish.
+//
+// If VirtualUsers is given, the load is a closed model instead: each
+// virtual user runs one iteration after another for the duration, and
+// starts each iteration at least the pacing of the task after the previous
+// one. Arrival, Rate and Stages cannot be used with virtual users.
+//
+// Arrival can be one of:
+// - constant: iterations are evenly spaced. This is the default.
+// - poisson: inter-arrival times are exponentially distributed.
+// - step: like constant, but the rate increases by StepRate every
+// StepInterval.
+//
+// If Stages is not empty, the rate follows the stages one after another and
+// Duration is ignored. Rate is then the rate at the beginning of the first
+// stage.
+//
+// The environments of the iterations are not kept. The task returns the
+// environments of the last iteration which finished.
+type LoadSpec struct {
+	Arrival         string           `json:"arrival,omitempty"`
+	Rate            float64          `json:"rate"`
+	Duration        string           `json:"duration,omitempty"`
+	StepRate        float64          `json:"step-rate,omitempty"`
+	StepInterval    string           `json:"step-interval,omitempty"`
+	Stages          []*LoadStageSpec `json:"stages,omitempty"`
+	MaxNrIterations int64            `json:"max-nr-iterations,omitempty"`
+	VirtualUsers    int              `json:"virtual-users,omitempty"`
+}
+
+// A stage changes the rate linearly from the target of the previous stage
+// to its own target over its duration. A stage whose target equals the
+// previous one holds the rate.
+type LoadStageSpec struct {
+	Name     string  `json:"name,omitempty"`
+	Duration string  `json:"duration"`
+	Target   float64 `json:"target"`
+}
+
+// The rate is integrated over steps of this length to find the arrivals.
+// The rate at the middle of a step is used for the whole step, which is
+// exact for the linear ramps of the stages.
+const arrivalStep = time.Millisecond
+
+type loadStage struct {
+	name  string
+	begin time.Duration
+	end   time.Duration
+	from  float64
+	to    float64
+}
+
+type loadGenerator struct {
+	duration        time.Duration
+	maxNrIterations int64
+	virtualUsers    int
+	poisson         bool
+	rate            func(t time.Duration) float64
+	stages          []*loadStage
+}
+
+func (self *LoadSpec) getStages() (stages []*loadStage, err error) {
+	var begin time.Duration
+	from := self.Rate
+	stages = make([]*loadStage, 0, len(self.Stages))
+	for i, spec := range self.Stages {
+		stage := new(loadStage)
+		stage.name = spec.Name
+		if len(stage.name) == 0 {
+			stage.name = fmt.Sprintf("stage-%v", i)
+		}
+		var d time.Duration
+		d, err = time.ParseDuration(spec.Duration)
+		if err != nil {
+			err = fmt.Errorf("load: stage %v has invalid duration %v: %v", stage.name, spec.Duration, err)
+			return
+		}
+		if d <= 0 {
+			err = fmt.Errorf("load: stage %v should have a positive duration", stage.name)
+			return
+		}
+		if spec.Target < 0 {
+			err = fmt.Errorf("load: stage %v has negative target %v", stage.name, spec.Target)
+			return
+		}
+		stage.begin = begin
+		stage.end = begin + d
+		stage.from = from
+		stage.to = spec.Target
+		stages = append(stages, stage)
+		begin = stage.end
+		from = spec.Target
+	}
+	return
+}
+
+func (self *LoadSpec) getGenerator() (gen *loadGenerator, err error) {
+	ret := new(loadGenerator)
+	if self.Rate < 0 {
+		err = fmt.Errorf("load: negative rate %v", self.Rate)
+		return
+	}
+	ret.maxNrIterations = self.MaxNrIterations
+	if self.VirtualUsers < 0 {
+		err = fmt.Errorf("load: negative number of virtual users %v", self.VirtualUsers)
+		return
+	}
+	if self.VirtualUsers > 0 {
+		if len(self.Arrival) > 0 || self.Rate != 0 || len(self.Stages) > 0 {
+			err = fmt.Errorf("load: arrival, rate and stages cannot be used with virtual users")
+			return
+		}
+		ret.virtualUsers = self.VirtualUsers
+		ret.duration, err = time.ParseDuration(self.Duration)
+		if err != nil {
+			err = fmt.Errorf("load: invalid duration %v: %v", self.Duration, err)
+			return
+		}
+		gen = ret
+		return
+	}
+	if len(self.Stages) > 0 {
+		if self.Arrival == "step" {
+			err = fmt.Errorf("load: step arrival cannot be used with stages")
+			return
+		}
+		ret.stages, err = self.getStages()
+		if err != nil {
+			return
+		}
+		ret.duration = ret.stages[len(ret.stages)-1].end
+		ret.rate = ret.stagedRate
+	} else {
+		ret.duration, err = time.ParseDuration(self.Duration)
+		if err != nil {
+			err = fmt.Errorf("load: invalid duration %v: %v", self.Duration, err)
+			return
+		}
+		rate := self.Rate
+		ret.rate = func(t time.Duration) float64 {
+			return rate
+		}
+	}
+	switch self.Arrival {
+	case "", "constant":
+	case "poisson":
+		ret.poisson = true
+	case "step":
+		var interval time.Duration
+		interval, err = time.ParseDuration(self.StepInterval)
+		if err != nil {
+			err = fmt.Errorf("load: invalid step interval %v: %v", self.StepInterval, err)
+			return
+		}
+		if interval <= 0 {
+			err = fmt.Errorf("load: step interval should be positive")
+			return
+		}
+		rate := self.Rate
+		step := self.StepRate
+		ret.rate = func(t time.Duration) float64 {
+			return rate + step*float64(t/interval)
+		}
+	default:
+		err = fmt.Errorf("load: unknown arrival %v", self.Arrival)
+		return
+	}
+	gen = ret
+	return
+}
+
+func (self *loadGenerator) stageAt(t time.Duration) *loadStage {
+	for _, stage := range self.stages {
+		if t < stage.end {
+			return stage
+		}
+	}
+	return nil
+}
+
+func (self *loadGenerator) stagedRate(t time.Duration) float64 {
+	stage := self.stageAt(t)
+	if stage == nil {
+		return 0
+	}
+	progress := float64(t-stage.begin) / float64(stage.end-stage.begin)
+	return stage.from + (stage.to-stage.from)*progress
+}
+
+// stage returns the name of the stage at offset t, or an empty string if
+// there is no stage.
+func (self *loadGenerator) stage(t time.Duration) string {
+	if stage := self.stageAt(t); stage != nil {
+		return stage.name
+	}
+	return ""
+}
+
+// next returns the offset of the arrival after the one at t, which is where
+// the rate integrated from t reaches area. An area of 0 gives the first
+// offset from t at which the rate is positive. It returns the duration if
+// there is no such offset.
+func (self *loadGenerator) next(t time.Duration, area float64) time.Duration {
+	for t < self.duration {
+		// The steps are aligned, so that the changes of the rate at
+		// round offsets, e.g. those of step arrival, fall between them.
+		h := arrivalStep - t%arrivalStep
+		if t+h > self.duration {
+			h = self.duration - t
+		}
+		r := self.rate(t + h/2)
+		if r > 0 && area <= r*h.Seconds() {
+			d := time.Duration(area / r * float64(time.Second))
+			return t + d.Round(time.Microsecond)
+		}
+		if r > 0 {
+			area -= r * h.Seconds()
+		}
+		t += h
+	}
+	return self.duration
+}
+
+// area returns the area under the rate between two arrivals: 1 for evenly
+// spaced arrivals, or exponentially distributed for poisson arrivals.
+func (self *loadGenerator) area() float64 {
+	if self.poisson {
+		return rand.ExpFloat64()
+	}
+	return 1
+}
+
+// run calls start at each arrival until the duration expires, the maximum
+// number of iterations is reached or start returns false. The arrivals are
+// scheduled against the start time, so a slow callback does not lower the
+// offered load. t is the offset of the arrival from the beginning of the
+// load and scheduled is the time at which the arrival was supposed to
+// happen.
+func (self *loadGenerator) run(start func(t time.Duration, scheduled time.Time) bool) {
+	begin := time.Now()
+	var n int64
+	for t := self.next(0, 0); t < self.duration; t = self.next(t, self.area()) {
+		if self.maxNrIterations > 0 && n >= self.maxNrIterations {
+			break
+		}
+		if sleep := begin.Add(t).Sub(time.Now()); sleep > 0 {
+			time.Sleep(sleep)
+		}
+		if !start(t, begin.Add(t)) {
+			break
+		}
+		n++
+	}
+}
+
+// executeLoad returns the environments of the last iteration to finish.
+func (self *worker) executeLoad(errChan chan<- error) []*Env {
+	if self.load.virtualUsers > 0 {
+		return self.executeVirtualUsers(errChan)
+	}
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	var envs []*Env
+	self.load.run(func(t time.Duration, scheduled time.Time) bool {
+		it := self.newIteration()
+		it.stage = self.load.stage(t)
+		it.start = scheduled
+		// Rows are taken here so that sequential feeders hand them
+		// out in the order of the arrivals.
+		if !self.feed(it) {
+			return false
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer self.release(it)
+			e := self.executeIteration(it, errChan)
+			lock.Lock()
+			defer lock.Unlock()
+			envs = e
+		}()
+		return true
+	})
+	wg.Wait()
+	return envs
+}
+
+// executeVirtualUsers runs the iterations of each virtual user one after
+// another until the duration expires. Like executeLoad, it returns the
+// environments of the last iteration to finish.
+func (self *worker) executeVirtualUsers(errChan chan<- error) []*Env {
+	end := time.Now().Add(self.load.duration)
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	var envs []*Env
+	var n int64
+	for i := 0; i < self.load.virtualUsers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			next := time.Now()
+			for {
+				if sleep := next.Sub(time.Now()); sleep > 0 {
+					time.Sleep(sleep)
+				}
+				start := time.Now()
+				if !start.Before(end) {
+					return
+				}
+				lock.Lock()
+				if self.load.maxNrIterations > 0 && n >= self.load.maxNrIterations {
+					lock.Unlock()
+					return
+				}
+				n++
+				lock.Unlock()
+
+				it := self.newIteration()
+				it.start = start
+				if !self.feed(it) {
+					return
+				}
+				e := self.executeIteration(it, errChan)
+				self.release(it)
+				lock.Lock()
+				envs = e
+				lock.Unlock()
+				next = start.Add(self.pacing)
+			}
+		}()
+	}
+	wg.Wait()
+	return envs
+}
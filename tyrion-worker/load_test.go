@@ -0,0 +1,371 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingResponseReader counts the requests, each of which takes d.
+type countingResponseReader struct {
+	n int64
+	d time.Duration
+	closer
+}
+
+func (self *countingResponseReader) ReadResponse(req *Request, env *Env) (resp *Response, updates *Env, err error) {
+	atomic.AddInt64(&self.n, 1)
+	time.Sleep(self.d)
+	resp = &Response{Status: 200}
+	return
+}
+
+func (self *countingResponseReader) Count() int64 {
+	return atomic.LoadInt64(&self.n)
+}
+
+func genSingleActionTask() *TaskSpec {
+	ca := new(ConcurrentActions)
+	spec := new(ActionSpec)
+	spec.Tag = "ping"
+	spec.URLTemplate = "http://localhost/ping"
+	spec.Method = "GET"
+	spec.ExpStatuses = []int{200}
+	ca.Actions = []*ActionSpec{spec}
+	taskSpec := new(TaskSpec)
+	taskSpec.ConcurrentActions = []*ConcurrentActions{ca}
+	return taskSpec
+}
+
+func runTask(t *testing.T, taskSpec *TaskSpec, rr ResponseReader) []*Env {
+	worker, err := taskSpec.GetWorker(rr)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	errChan := make(chan error)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for err := range errChan {
+			t.Errorf("Error: %v", err)
+		}
+	}()
+	envs := worker.Execute(errChan)
+	close(errChan)
+	wg.Wait()
+	return envs
+}
+
+func TestLoadConstantRate(t *testing.T) {
+	StartWorkers(10)
+	defer StopAllWorkers()
+
+	taskSpec := genSingleActionTask()
+	taskSpec.Load = &LoadSpec{
+		Rate:     100,
+		Duration: "500ms",
+	}
+	rr := new(countingResponseReader)
+	runTask(t, taskSpec, rr)
+	if n := rr.Count(); n != 50 {
+		t.Errorf("Sent %v requests, should be 50", n)
+	}
+}
+
+func TestLoadMaxNrIterations(t *testing.T) {
+	StartWorkers(10)
+	defer StopAllWorkers()
+
+	taskSpec := genSingleActionTask()
+	taskSpec.Load = &LoadSpec{
+		Arrival:         "poisson",
+		Rate:            1000,
+		Duration:        "10s",
+		MaxNrIterations: 20,
+	}
+	rr := new(countingResponseReader)
+	start := time.Now()
+	runTask(t, taskSpec, rr)
+	if n := rr.Count(); n != 20 {
+		t.Errorf("Sent %v requests, should be 20", n)
+	}
+	if d := time.Now().Sub(start); d > 5*time.Second {
+		t.Errorf("Took %v to send 20 requests", d)
+	}
+}
+
+func TestLoadReturnsLastIteration(t *testing.T) {
+	StartWorkers(10)
+	defer StopAllWorkers()
+
+	taskSpec := genPollTask(new(ConcurrentActions))
+	taskSpec.Load = &LoadSpec{
+		Rate:     200,
+		Duration: "100ms",
+	}
+	rr := &jobResponseReader{doneAfter: 1000}
+	envs := runTask(t, taskSpec, rr)
+	if rr.nrPolls != 20 {
+		t.Errorf("Sent %v requests, should be 20", rr.nrPolls)
+	}
+	if len(envs) != 1 {
+		t.Errorf("Should only return the envs of one iteration: %v", envs)
+	}
+}
+
+func TestLoadStepRate(t *testing.T) {
+	spec := &LoadSpec{
+		Arrival:      "step",
+		Rate:         10,
+		Duration:     "1m",
+		StepRate:     5,
+		StepInterval: "10s",
+	}
+	gen, err := spec.getGenerator()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if r := gen.rate(5 * time.Second); r != 10 {
+		t.Errorf("Rate at 5s should be 10, not %v", r)
+	}
+	if r := gen.rate(25 * time.Second); r != 20 {
+		t.Errorf("Rate at 25s should be 20, not %v", r)
+	}
+	if d := gen.next(25*time.Second, 1) - 25*time.Second; d != 50*time.Millisecond {
+		t.Errorf("Interval at 25s should be 50ms, not %v", d)
+	}
+	// Half of the area is before the step at 10s and the other half at
+	// the rate of 15.
+	if d := gen.next(9950*time.Millisecond, 1); d != 10*time.Second+33333*time.Microsecond {
+		t.Errorf("The arrival after 9.95s should be at 10.033333s, not %v", d)
+	}
+}
+
+// countArrivals walks through the arrivals of a generator.
+func countArrivals(gen *loadGenerator) (n int, arrivals map[string]int) {
+	arrivals = make(map[string]int, len(gen.stages))
+	for t := gen.next(0, 0); t < gen.duration; t = gen.next(t, 1) {
+		n++
+		arrivals[gen.stage(t)]++
+	}
+	return
+}
+
+func TestLoadRampArrivals(t *testing.T) {
+	spec := &LoadSpec{
+		Stages: []*LoadStageSpec{
+			&LoadStageSpec{Name: "ramp-up", Duration: "60s", Target: 200},
+			&LoadStageSpec{Name: "hold", Duration: "10s", Target: 200},
+			&LoadStageSpec{Name: "ramp-down", Duration: "30s", Target: 0},
+		},
+	}
+	gen, err := spec.getGenerator()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	// The integrals of the rate over the stages.
+	exp := map[string]int{"ramp-up": 6000, "hold": 2000, "ramp-down": 3000}
+	n, arrivals := countArrivals(gen)
+	if n < 10999 || n > 11001 {
+		t.Errorf("%v arrivals, should be about 11000", n)
+	}
+	for name, e := range exp {
+		if a := arrivals[name]; a < e-1 || a > e+1 {
+			t.Errorf("%v arrivals in %v, should be about %v", a, name, e)
+		}
+	}
+
+	// The first half of the ramp up has a quarter of its arrivals.
+	half := 0
+	for t := gen.next(0, 0); t < 30*time.Second; t = gen.next(t, 1) {
+		half++
+	}
+	if half < 1499 || half > 1501 {
+		t.Errorf("%v arrivals in the first 30s, should be about 1500", half)
+	}
+}
+
+func TestLoadStepArrivals(t *testing.T) {
+	spec := &LoadSpec{
+		Arrival:      "step",
+		Rate:         0.5,
+		Duration:     "30s",
+		StepRate:     10,
+		StepInterval: "10s",
+	}
+	gen, err := spec.getGenerator()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	// 5 arrivals at 0.5/s, 105 at 10.5/s and 205 at 20.5/s.
+	if n, _ := countArrivals(gen); n < 314 || n > 316 {
+		t.Errorf("%v arrivals, should be about 315", n)
+	}
+}
+
+func TestLoadInvalidSpec(t *testing.T) {
+	specs := []*LoadSpec{
+		&LoadSpec{Rate: 10, Duration: "forever"},
+		&LoadSpec{Rate: 10, Duration: "1s", Arrival: "burst"},
+		&LoadSpec{Rate: 10, Duration: "1s", Arrival: "step"},
+		&LoadSpec{Rate: -1, Duration: "1s"},
+		&LoadSpec{VirtualUsers: -1, Duration: "1s"},
+		&LoadSpec{VirtualUsers: 2},
+		&LoadSpec{VirtualUsers: 2, Rate: 10, Duration: "1s"},
+		&LoadSpec{VirtualUsers: 2, Arrival: "poisson", Duration: "1s"},
+		&LoadSpec{VirtualUsers: 2, Stages: []*LoadStageSpec{&LoadStageSpec{Duration: "1s", Target: 10}}},
+	}
+	for _, spec := range specs {
+		if _, err := spec.getGenerator(); err == nil {
+			t.Errorf("%+v should be invalid", spec)
+		}
+	}
+}
+
+type stageRecorder struct {
+	stages map[string]int
+	lock   sync.Mutex
+	closer
+}
+
+func (self *stageRecorder) ReadResponse(req *Request, env *Env) (resp *Response, updates *Env, err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.stages[req.Stage]++
+	resp = &Response{Status: 200}
+	return
+}
+
+func TestLoadStages(t *testing.T) {
+	spec := &LoadSpec{
+		Stages: []*LoadStageSpec{
+			&LoadStageSpec{Name: "ramp-up", Duration: "60s", Target: 200},
+			&LoadStageSpec{Name: "hold", Duration: "5m", Target: 200},
+			&LoadStageSpec{Duration: "60s", Target: 0},
+		},
+	}
+	gen, err := spec.getGenerator()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if gen.duration != 7*time.Minute {
+		t.Errorf("Duration should be 7m, not %v", gen.duration)
+	}
+	if r := gen.rate(30 * time.Second); r != 100 {
+		t.Errorf("Rate at 30s should be 100, not %v", r)
+	}
+	if r := gen.rate(3 * time.Minute); r != 200 {
+		t.Errorf("Rate at 3m should be 200, not %v", r)
+	}
+	if r := gen.rate(390 * time.Second); r != 100 {
+		t.Errorf("Rate at 6m30s should be 100, not %v", r)
+	}
+	if s := gen.stage(3 * time.Minute); s != "hold" {
+		t.Errorf("Stage at 3m should be hold, not %v", s)
+	}
+	if s := gen.stage(390 * time.Second); s != "stage-2" {
+		t.Errorf("Stage at 6m30s should be stage-2, not %v", s)
+	}
+	if s := gen.stage(8 * time.Minute); s != "" {
+		t.Errorf("Stage at 8m should be empty, not %v", s)
+	}
+}
+
+func TestLoadStagesRecorded(t *testing.T) {
+	StartWorkers(10)
+	defer StopAllWorkers()
+
+	taskSpec := genSingleActionTask()
+	taskSpec.Load = &LoadSpec{
+		Rate: 100,
+		Stages: []*LoadStageSpec{
+			&LoadStageSpec{Name: "first", Duration: "200ms", Target: 100},
+			&LoadStageSpec{Name: "second", Duration: "200ms", Target: 100},
+		},
+	}
+	rr := &stageRecorder{stages: make(map[string]int, 2)}
+	runTask(t, taskSpec, rr)
+	if len(rr.stages) != 2 || rr.stages["first"] != 20 || rr.stages["second"] != 20 {
+		t.Errorf("Requests in each stage: %+v", rr.stages)
+	}
+}
+
+func TestVirtualUsers(t *testing.T) {
+	StartWorkers(10)
+	defer StopAllWorkers()
+
+	taskSpec := genSingleActionTask()
+	taskSpec.Load = &LoadSpec{
+		VirtualUsers: 2,
+		Duration:     "100ms",
+	}
+	rr := &countingResponseReader{d: 10 * time.Millisecond}
+	start := time.Now()
+	runTask(t, taskSpec, rr)
+	if d := time.Since(start); d < 100*time.Millisecond {
+		t.Errorf("Should run for 100ms, but took %v", d)
+	}
+	// Each user waits for its iteration to finish before starting the
+	// next one.
+	if n := rr.Count(); n < 4 || n > 20 {
+		t.Errorf("Sent %v requests, should be at most 20", n)
+	}
+}
+
+func TestVirtualUsersPacing(t *testing.T) {
+	StartWorkers(10)
+	defer StopAllWorkers()
+
+	taskSpec := genSingleActionTask()
+	taskSpec.Pacing = "100ms"
+	taskSpec.Load = &LoadSpec{
+		VirtualUsers: 2,
+		Duration:     "250ms",
+	}
+	rr := new(countingResponseReader)
+	runTask(t, taskSpec, rr)
+	// Each user starts its iterations at 0, 100ms and 200ms.
+	if n := rr.Count(); n != 6 {
+		t.Errorf("Sent %v requests, should be 6", n)
+	}
+}
+
+func TestVirtualUsersMaxNrIterations(t *testing.T) {
+	StartWorkers(10)
+	defer StopAllWorkers()
+
+	taskSpec := genSingleActionTask()
+	taskSpec.Load = &LoadSpec{
+		VirtualUsers:    3,
+		Duration:        "10s",
+		MaxNrIterations: 5,
+	}
+	rr := new(countingResponseReader)
+	start := time.Now()
+	runTask(t, taskSpec, rr)
+	if n := rr.Count(); n != 5 {
+		t.Errorf("Sent %v requests, should be 5", n)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("Took %v to send 5 requests", d)
+	}
+}
+
+func TestPacingNeedsVirtualUsers(t *testing.T) {
+	taskSpec := genSingleActionTask()
+	taskSpec.Pacing = "100ms"
+	if _, err := taskSpec.GetWorker(new(countingResponseReader)); err == nil {
+		t.Errorf("Pacing without a load should be an error")
+	}
+	taskSpec.Load = &LoadSpec{Rate: 10, Duration: "1s"}
+	if _, err := taskSpec.GetWorker(new(countingResponseReader)); err == nil {
+		t.Errorf("Pacing with an open-model load should be an error")
+	}
+	taskSpec.Load = &LoadSpec{VirtualUsers: 1, Duration: "1s"}
+	taskSpec.Pacing = "soon"
+	if _, err := taskSpec.GetWorker(new(countingResponseReader)); err == nil {
+		t.Errorf("Invalid pacing should be an error")
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"text/template"
+	"time"
+)
+
+// The number of times a step with an until condition runs at most, if
+// max-iterations is not given.
+const defaultMaxIterations = 100
+
+// stageLoop decides how many times a step runs. The environments produced
+// by one iteration are the input of the next one.
+type stageLoop struct {
+	repeat   int
+	until    *condition
+	max      int
+	interval time.Duration
+}
+
+func (self *ConcurrentActions) getLoop(funcs template.FuncMap) (loop *stageLoop, err error) {
+	ret := new(stageLoop)
+	if self.Repeat < 0 {
+		err = fmt.Errorf("repeat should not be negative: %v", self.Repeat)
+		return
+	}
+	if self.MaxIterations < 0 {
+		err = fmt.Errorf("max-iterations should not be negative: %v", self.MaxIterations)
+		return
+	}
+	ret.until, err = newCondition(self.Until, funcs)
+	if err != nil {
+		return
+	}
+	if ret.until != nil && self.Repeat > 0 {
+		err = fmt.Errorf("repeat and until cannot be used together")
+		return
+	}
+	ret.repeat = self.Repeat
+	if ret.repeat == 0 {
+		ret.repeat = 1
+	}
+	ret.max = self.MaxIterations
+	if ret.max == 0 {
+		ret.max = defaultMaxIterations
+	}
+	if len(self.Interval) > 0 {
+		ret.interval, err = time.ParseDuration(self.Interval)
+		if err != nil {
+			err = fmt.Errorf("invalid interval %v: %v", self.Interval, err)
+			return
+		}
+	}
+	loop = ret
+	return
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// jobResponseReader reports a job as pending, or in the state given by
+// pending, until it has been polled doneAfter times.
+type jobResponseReader struct {
+	doneAfter int
+	pending   string
+	nrPolls   int
+	lock      sync.Mutex
+	closer
+}
+
+func (self *jobResponseReader) ReadResponse(req *Request, env *Env) (resp *Response, updates *Env, err error) {
+	self.lock.Lock()
+	self.nrPolls++
+	state := self.pending
+	if len(state) == 0 {
+		state = "pending"
+	}
+	if self.nrPolls >= self.doneAfter {
+		state = "done"
+	}
+	body := fmt.Sprintf("state=%v; poll=%v", state, self.nrPolls)
+	self.lock.Unlock()
+	resp = &Response{Status: 200, Body: ioutil.NopCloser(strings.NewReader(body))}
+	return
+}
+
+func genPollTask(ca *ConcurrentActions) *TaskSpec {
+	spec := &ActionSpec{
+		Tag:         "poll",
+		URLTemplate: "http://localhost/job",
+		Method:      "GET",
+		RespTemps:   []string{`state=(?P<state>[^;]+); poll=(?P<poll>\d+)`},
+	}
+	ca.Actions = []*ActionSpec{spec}
+	taskSpec := new(TaskSpec)
+	taskSpec.ConcurrentActions = []*ConcurrentActions{ca}
+	return taskSpec
+}
+
+func TestLoopRepeat(t *testing.T) {
+	StartWorkers(4)
+	defer StopAllWorkers()
+
+	taskSpec := genPollTask(&ConcurrentActions{Repeat: 3})
+	rr := &jobResponseReader{doneAfter: 100}
+	envs := runTask(t, taskSpec, rr)
+	if rr.nrPolls != 3 {
+		t.Errorf("Polled %v times, instead of 3", rr.nrPolls)
+	}
+	if len(envs) != 1 || envs[0].NameValuePairs["poll"] != "3" {
+		t.Errorf("Wrong envs: %v", envs)
+	}
+}
+
+func TestLoopUntil(t *testing.T) {
+	StartWorkers(4)
+	defer StopAllWorkers()
+
+	taskSpec := genPollTask(&ConcurrentActions{
+		Until:         `{{.state}} == "done"`,
+		MaxIterations: 10,
+		Interval:      "10ms",
+	})
+	rr := &jobResponseReader{doneAfter: 3}
+	start := time.Now()
+	envs := runTask(t, taskSpec, rr)
+	if rr.nrPolls != 3 {
+		t.Errorf("Polled %v times, instead of 3", rr.nrPolls)
+	}
+	if d := time.Since(start); d < 20*time.Millisecond {
+		t.Errorf("Should wait between the iterations, but took %v", d)
+	}
+	if len(envs) != 1 || envs[0].NameValuePairs["state"] != "done" {
+		t.Errorf("Wrong envs: %v", envs)
+	}
+}
+
+// A state which looks like a comparison should not end the loop.
+func TestLoopUntilStateWithOperators(t *testing.T) {
+	StartWorkers(4)
+	defer StopAllWorkers()
+
+	for _, pending := range []string{"x != done", "done == x", `"done`} {
+		taskSpec := genPollTask(&ConcurrentActions{
+			Until:         `{{.state}} == "done"`,
+			MaxIterations: 10,
+		})
+		rr := &jobResponseReader{doneAfter: 3, pending: pending}
+		envs := runTask(t, taskSpec, rr)
+		if rr.nrPolls != 3 {
+			t.Errorf("%v: polled %v times, instead of 3", pending, rr.nrPolls)
+		}
+		if len(envs) != 1 || envs[0].NameValuePairs["state"] != "done" {
+			t.Errorf("%v: wrong envs: %v", pending, envs)
+		}
+	}
+}
+
+func TestLoopUntilMaxIterations(t *testing.T) {
+	StartWorkers(4)
+	defer StopAllWorkers()
+
+	taskSpec := genPollTask(&ConcurrentActions{
+		Until:         `{{.state}} == "done"`,
+		MaxIterations: 2,
+	})
+	rr := &jobResponseReader{doneAfter: 5}
+	worker, err := taskSpec.GetWorker(rr)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	errChan := make(chan error, 10)
+	worker.Execute(errChan)
+	close(errChan)
+	nrErrs := 0
+	for err := range errChan {
+		if !strings.Contains(err.Error(), "does not hold after 2 iterations") {
+			t.Errorf("Unexpected error: %v", err)
+		}
+		nrErrs++
+	}
+	if nrErrs != 1 {
+		t.Errorf("Got %v errors, instead of 1", nrErrs)
+	}
+	if rr.nrPolls != 2 {
+		t.Errorf("Polled %v times, instead of 2", rr.nrPolls)
+	}
+}
+
+func TestInvalidLoops(t *testing.T) {
+	loops := []*ConcurrentActions{
+		&ConcurrentActions{Repeat: -1},
+		&ConcurrentActions{MaxIterations: -1},
+		&ConcurrentActions{Repeat: 2, Until: "{{.state}}"},
+		&ConcurrentActions{Until: "{{.state"},
+		&ConcurrentActions{Interval: "soon"},
+	}
+	for _, ca := range loops {
+		if _, err := ca.getLoop(nil); err == nil {
+			t.Errorf("Should be an error: %+v", ca)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/andybalholm/cascadia"
+	"github.com/antchfx/htmlquery"
+	"github.com/antchfx/xmlquery"
+	"github.com/antchfx/xpath"
+	"golang.org/x/net/html"
+)
+
+// NodeExtractorSpec binds the nodes selected from an HTML or XML response
+// to a variable. Exactly one of CSS and XPath should be given. CSS selectors
+// only work on HTML.
+//
+// The variable takes the value of the attribute Attr of the node, or the
+// text inside the node if Attr is empty. e.g.
+//
+//	{"var": "csrf", "css": "input[name=csrf]", "attr": "value"}
+//
+// Each matched node produces a fork. The nodes matched by different
+// extractors of the same action are zipped by their order in the document.
+type NodeExtractorSpec struct {
+	Var   string `json:"var"`
+	CSS   string `json:"css,omitempty"`
+	XPath string `json:"xpath,omitempty"`
+	Attr  string `json:"attr,omitempty"`
+	// Parse the response as XML instead of HTML.
+	XML bool `json:"xml,omitempty"`
+}
+
+type nodeExtractor struct {
+	name  string
+	attr  string
+	xml   bool
+	css   cascadia.Sel
+	xpath *xpath.Expr
+}
+
+func (self *NodeExtractorSpec) getExtractor() (e *nodeExtractor, err error) {
+	ret := new(nodeExtractor)
+	if len(self.Var) == 0 {
+		err = fmt.Errorf("node extractor %v%v needs a variable name", self.CSS, self.XPath)
+		return
+	}
+	ret.name = self.Var
+	ret.attr = self.Attr
+	ret.xml = self.XML
+	switch {
+	case len(self.CSS) > 0 && len(self.XPath) > 0:
+		err = fmt.Errorf("node extractor %v has both css and xpath", self.Var)
+		return
+	case len(self.CSS) > 0:
+		if self.XML {
+			err = fmt.Errorf("node extractor %v: css selectors only work on HTML", self.Var)
+			return
+		}
+		ret.css, err = cascadia.Parse(self.CSS)
+		if err != nil {
+			err = fmt.Errorf("%v is not a valid css selector: %v", self.CSS, err)
+			return
+		}
+	case len(self.XPath) > 0:
+		ret.xpath, err = xpath.Compile(self.XPath)
+		if err != nil {
+			err = fmt.Errorf("%v is not a valid xpath: %v", self.XPath, err)
+			return
+		}
+	default:
+		err = fmt.Errorf("node extractor %v needs either css or xpath", self.Var)
+		return
+	}
+	e = ret
+	return
+}
+
+func (self *nodeExtractor) htmlValues(doc *html.Node) []string {
+	var nodes []*html.Node
+	if self.css != nil {
+		nodes = cascadia.QueryAll(doc, self.css)
+	} else {
+		nodes = htmlquery.QuerySelectorAll(doc, self.xpath)
+	}
+	ret := make([]string, 0, len(nodes))
+	for _, n := range nodes {
+		if len(self.attr) > 0 {
+			if !htmlquery.ExistsAttr(n, self.attr) {
+				continue
+			}
+			ret = append(ret, htmlquery.SelectAttr(n, self.attr))
+			continue
+		}
+		ret = append(ret, strings.TrimSpace(htmlquery.InnerText(n)))
+	}
+	return ret
+}
+
+func (self *nodeExtractor) xmlValues(doc *xmlquery.Node) []string {
+	nodes := xmlquery.QuerySelectorAll(doc, self.xpath)
+	ret := make([]string, 0, len(nodes))
+	for _, n := range nodes {
+		if len(self.attr) > 0 {
+			found := false
+			for _, a := range n.Attr {
+				if a.Name.Local == self.attr {
+					found = true
+					break
+				}
+			}
+			if !found {
+				continue
+			}
+			ret = append(ret, n.SelectAttr(self.attr))
+			continue
+		}
+		ret = append(ret, strings.TrimSpace(n.InnerText()))
+	}
+	return ret
+}
+
+// extractNodes applies the extractors to the body and returns one
+// environment per fork, see zipValues. Extractors which do not select any
+// node are ignored. The body is parsed at most once as HTML and once as
+// XML.
+func extractNodes(extractors []*nodeExtractor, body []byte) (envs []*Env, err error) {
+	var htmlDoc *html.Node
+	var xmlDoc *xmlquery.Node
+	values := make(map[string][]string, len(extractors))
+	for _, e := range extractors {
+		var vs []string
+		if e.xml {
+			if xmlDoc == nil {
+				xmlDoc, err = xmlquery.Parse(bytes.NewReader(body))
+				if err != nil {
+					err = fmt.Errorf("response is not valid XML: %v", err)
+					return
+				}
+			}
+			vs = e.xmlValues(xmlDoc)
+		} else {
+			if htmlDoc == nil {
+				htmlDoc, err = html.Parse(bytes.NewReader(body))
+				if err != nil {
+					err = fmt.Errorf("response is not valid HTML: %v", err)
+					return
+				}
+			}
+			vs = e.htmlValues(htmlDoc)
+		}
+		if len(vs) > 0 {
+			values[e.name] = vs
+		}
+	}
+	envs = zipValues(values, nil)
+	return
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"testing"
+)
+
+const loginPage = `<html>
+<head><title> Login </title></head>
+<body>
+<form action="/login" method="POST">
+	<input type="hidden" name="csrf" value="t0ken">
+	<input type="text" name="user">
+</form>
+<ul>
+	<li><a href="/items/1">First</a></li>
+	<li><a href="/items/2">Second</a></li>
+	<li><a>No link</a></li>
+</ul>
+</body>
+</html>`
+
+func TestPerformActionCSSExtractor(t *testing.T) {
+	as := &ActionSpec{
+		RespNodes: []*NodeExtractorSpec{
+			&NodeExtractorSpec{Var: "csrf", CSS: "input[name=csrf]", Attr: "value"},
+			&NodeExtractorSpec{Var: "title", CSS: "title"},
+		},
+	}
+	updates, err := performActionOnBody(t, as, loginPage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(updates) != 1 {
+		t.Fatalf("Got %v updates, instead of 1", len(updates))
+	}
+	exp := map[string]string{"csrf": "t0ken", "title": "Login"}
+	if !stringMapEq(exp, updates[0].NameValuePairs) {
+		t.Errorf("update should be %v, not %v", exp, updates[0].NameValuePairs)
+	}
+}
+
+func TestPerformActionXPathForks(t *testing.T) {
+	as := &ActionSpec{
+		RespNodes: []*NodeExtractorSpec{
+			&NodeExtractorSpec{Var: "link", XPath: "//li/a", Attr: "href"},
+			&NodeExtractorSpec{Var: "name", XPath: "//li/a[@href]"},
+		},
+	}
+	updates, err := performActionOnBody(t, as, loginPage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := []map[string]string{
+		{"link": "/items/1", "name": "First"},
+		{"link": "/items/2", "name": "Second"},
+	}
+	if len(updates) != len(exp) {
+		t.Fatalf("Got %v updates, instead of %v", len(updates), len(exp))
+	}
+	for i, u := range updates {
+		if !stringMapEq(exp[i], u.NameValuePairs) {
+			t.Errorf("updates[%v] should be %v, not %v", i, exp[i], u.NameValuePairs)
+		}
+	}
+}
+
+func TestPerformActionXMLExtractor(t *testing.T) {
+	body := `<?xml version="1.0"?>
+<users>
+	<user id="1"><name>Nan</name></user>
+	<user id="2"><name>Alan</name></user>
+</users>`
+	as := &ActionSpec{
+		RespNodes: []*NodeExtractorSpec{
+			&NodeExtractorSpec{Var: "id", XPath: "//user", Attr: "id", XML: true},
+			&NodeExtractorSpec{Var: "name", XPath: "//user/name", XML: true},
+		},
+		MaxNrForks: 1,
+	}
+	updates, err := performActionOnBody(t, as, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(updates) != 1 {
+		t.Fatalf("Got %v updates, instead of 1", len(updates))
+	}
+	u := updates[0].NameValuePairs
+	if !stringMapEq(u, map[string]string{"id": "1", "name": "Nan"}) &&
+		!stringMapEq(u, map[string]string{"id": "2", "name": "Alan"}) {
+		t.Errorf("Unexpected update: %v", u)
+	}
+}
+
+func TestPerformActionNodeMustMatch(t *testing.T) {
+	as := &ActionSpec{
+		RespNodes: []*NodeExtractorSpec{
+			&NodeExtractorSpec{Var: "token", CSS: "input[name=token]", Attr: "value"},
+		},
+		MustMatch: true,
+	}
+	_, err := performActionOnBody(t, as, loginPage)
+	if err == nil {
+		t.Error("Should be an error")
+	}
+}
+
+func TestInvalidNodeExtractors(t *testing.T) {
+	specs := []*NodeExtractorSpec{
+		&NodeExtractorSpec{CSS: "input"},
+		&NodeExtractorSpec{Var: "v"},
+		&NodeExtractorSpec{Var: "v", CSS: "input", XPath: "//input"},
+		&NodeExtractorSpec{Var: "v", CSS: "input", XML: true},
+		&NodeExtractorSpec{Var: "v", CSS: "input[["},
+		&NodeExtractorSpec{Var: "v", XPath: "//input[["},
+	}
+	for _, spec := range specs {
+		as := &ActionSpec{
+			URLTemplate: "http://localhost:8080/",
+			Method:      "GET",
+			Tag:         "sometag",
+			RespNodes:   []*NodeExtractorSpec{spec},
+		}
+		_, err := as.GetAction(nil)
+		if err == nil {
+			t.Errorf("%+v should be invalid", spec)
+		}
+	}
+}
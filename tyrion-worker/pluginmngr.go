@@ -3,7 +3,9 @@ package main
 import (
 	"fmt"
 	"regexp"
+	"strconv"
 	"sync"
+	"time"
 )
 
 type PluginSpec struct {
@@ -23,19 +25,21 @@ type pluginTagFilter struct {
 	rest   ResponseReader
 }
 
-func (self *pluginTagFilter) ReadResponse(req *Request, env *Env) (resp *Response, updates *Env, err error) {
+func (self *pluginTagFilter) match(req *Request) bool {
 	if len(self.tags) == 0 {
-		return self.plugin.ReadResponse(req, env)
+		return true
 	}
-	matched := false
 	for _, t := range self.tags {
 		m := t.FindString(req.Tag)
 		if len(m) > 0 {
-			matched = true
-			break
+			return true
 		}
 	}
-	if matched {
+	return false
+}
+
+func (self *pluginTagFilter) ReadResponse(req *Request, env *Env) (resp *Response, updates *Env, err error) {
+	if self.match(req) {
 		return self.plugin.ReadResponse(req, env)
 	}
 	if self.rest != nil {
@@ -44,6 +48,30 @@ func (self *pluginTagFilter) ReadResponse(req *Request, env *Env) (resp *Respons
 	return
 }
 
+// LatencySummaries collects the summaries from the plugin and the rest of
+// the chain.
+func (self *pluginTagFilter) LatencySummaries() []*LatencySummary {
+	var ret []*LatencySummary
+	if s, ok := self.plugin.(LatencySummarizer); ok {
+		ret = append(ret, s.LatencySummaries()...)
+	}
+	if s, ok := self.rest.(LatencySummarizer); ok {
+		ret = append(ret, s.LatencySummaries()...)
+	}
+	return ret
+}
+
+// RecordAssertionFailure tells the plugin about the failure if the plugin
+// has seen the request, and tells the rest of the chain as well.
+func (self *pluginTagFilter) RecordAssertionFailure(req *Request, err *AssertionError) {
+	if r, ok := self.plugin.(AssertionFailureRecorder); ok && self.match(req) {
+		r.RecordAssertionFailure(req, err)
+	}
+	if r, ok := self.rest.(AssertionFailureRecorder); ok {
+		r.RecordAssertionFailure(req, err)
+	}
+}
+
 func (self *pluginTagFilter) Close() error {
 	return self.plugin.Close()
 }
@@ -120,3 +148,42 @@ func (self *PluginManager) NewPluginChain(specs []*PluginSpec) (rr ResponseReade
 	rr = ret
 	return
 }
+
+func boolParam(params map[string]string, name string, defaultValue bool) (v bool, err error) {
+	str, ok := params[name]
+	if !ok || len(str) == 0 {
+		v = defaultValue
+		return
+	}
+	v, err = strconv.ParseBool(str)
+	if err != nil {
+		err = fmt.Errorf("parameter %v should be true or false: %v", name, str)
+	}
+	return
+}
+
+func intParam(params map[string]string, name string, defaultValue int) (v int, err error) {
+	str, ok := params[name]
+	if !ok || len(str) == 0 {
+		v = defaultValue
+		return
+	}
+	v, err = strconv.Atoi(str)
+	if err != nil {
+		err = fmt.Errorf("parameter %v should be an integer: %v", name, str)
+	}
+	return
+}
+
+func durationParam(params map[string]string, name string, defaultValue time.Duration) (v time.Duration, err error) {
+	str, ok := params[name]
+	if !ok || len(str) == 0 {
+		v = defaultValue
+		return
+	}
+	v, err = time.ParseDuration(str)
+	if err != nil {
+		err = fmt.Errorf("parameter %v should be a duration: %v", name, str)
+	}
+	return
+}
@@ -123,6 +123,10 @@ func (self *RetryPlugin) ReadResponse(
 		return
 	}
 	for self.shouldRetry(resp) {
+		// Give the connection back before trying again.
+		if resp != nil && resp.Body != nil {
+			resp.Body.Close()
+		}
 		sleep := time.Duration(rand.Int63n(int64(self.maxTimeOut)))
 		if sleep < 1*time.Second {
 			sleep = time.Second
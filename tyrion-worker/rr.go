@@ -5,6 +5,7 @@ import (
 	"io"
 	"net/http"
 	"net/url"
+	"time"
 )
 
 type Request struct {
@@ -14,10 +15,39 @@ type Request struct {
 	Content  *HttpRequestContent
 	URLQuery url.Values
 	Headers  http.Header
+	// The load stage in which the request was sent, if any.
+	Stage string
+	// The scenario of the task which sent the request, if any.
+	Scenario string
+	// The tag of the action before it is executed, e.g. get-{{.user}}.
+	// The timer summarizes the latencies by it, so that the number of
+	// summaries does not grow with the values of the variables.
+	TagTemplate string
+	// When the request was supposed to be sent. It may be earlier than
+	// the time it was actually sent if all workers were busy. Zero if
+	// unknown.
+	Scheduled time.Time
+}
+
+// sentURL returns the URL which is sent. The query in the URL is replaced
+// by URLQuery if it is not empty.
+func (self *Request) sentURL() (u *url.URL, err error) {
+	u, err = url.Parse(self.URL)
+	if err != nil {
+		return
+	}
+	if len(self.URLQuery) > 0 {
+		u.RawQuery = self.URLQuery.Encode()
+	}
+	return
 }
 
 func (self *Request) ToHttpRequest() (req *http.Request, err error) {
-	ret, err := http.NewRequest(self.Method, self.URL, &bytes.Buffer{})
+	u, err := self.sentURL()
+	if err != nil {
+		return
+	}
+	ret, err := http.NewRequest(self.Method, u.String(), &bytes.Buffer{})
 	if err != nil {
 		return
 	}
@@ -33,17 +63,29 @@ func (self *Request) ToHttpRequest() (req *http.Request, err error) {
 			ret.Header.Add(k, v)
 		}
 	}
-
-	if len(self.URLQuery) > 0 {
-		ret.URL.RawQuery = self.URLQuery.Encode()
-	}
 	req = ret
 	return
 }
 
+// FullURL returns the URL which is sent, with the query.
+func (self *Request) FullURL() string {
+	u, err := self.sentURL()
+	if err != nil {
+		return self.URL
+	}
+	return u.String()
+}
+
 type Response struct {
 	Status int
+	Header http.Header
 	Body   io.ReadCloser
+	// The protocol of the response, e.g. HTTP/1.1 or HTTP/2.0.
+	Proto string
+	// Number of bytes in the request body which were sent.
+	BytesSent int64
+	// Only available if the http plugin traces the request.
+	Phases *HttpPhases
 }
 
 type ResponseReader interface {
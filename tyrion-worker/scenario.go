@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+)
+
+// ScenarioSpec is one of the flows of a task. Each iteration of the task
+// picks a scenario at random, with a probability proportional to its
+// weight, e.g. weights of 70, 25 and 5 run the scenarios in 70%, 25% and
+// 5% of the iterations. The random choices follow the seed of the task.
+//
+// A scenario has either an action sequence or an action graph, which are
+// used like those of a task. The name of the scenario is given to the
+// requests, so that the timer logs and summarizes each scenario
+// separately.
+type ScenarioSpec struct {
+	Name              string               `json:"name"`
+	Weight            float64              `json:"weight"`
+	ConcurrentActions []*ConcurrentActions `json:"action-seq,omitempty"`
+	ActionGraph       *ActionGraph         `json:"action-graph,omitempty"`
+}
+
+type scenario struct {
+	name   string
+	weight float64
+	seq    []*ConcurrentActions
+	graph  *ActionGraph
+	nodes  []*actionNode
+}
+
+func newScenario(name string, seq []*ConcurrentActions, graph *ActionGraph) (s *scenario, err error) {
+	ret := new(scenario)
+	ret.name = name
+	ret.seq = seq
+	if graph != nil {
+		if len(seq) > 0 {
+			err = fmt.Errorf("action-seq and action-graph cannot be used together")
+			return
+		}
+		ret.graph = graph
+		ret.nodes, err = graph.getNodes()
+		if err != nil {
+			return
+		}
+	}
+	s = ret
+	return
+}
+
+func (self *ScenarioSpec) getScenario() (s *scenario, err error) {
+	if len(self.Name) == 0 {
+		err = fmt.Errorf("every scenario needs a name")
+		return
+	}
+	if self.Weight <= 0 {
+		err = fmt.Errorf("scenario %v should have a positive weight", self.Name)
+		return
+	}
+	s, err = newScenario(self.Name, self.ConcurrentActions, self.ActionGraph)
+	if err != nil {
+		err = fmt.Errorf("scenario %v: %v", self.Name, err)
+		return
+	}
+	s.weight = self.Weight
+	return
+}
+
+// getScenarios returns the scenarios of the task. A task without scenarios
+// has a single unnamed one with its own action sequence or graph.
+func (self *TaskSpec) getScenarios() (scenarios []*scenario, err error) {
+	if len(self.Scenarios) == 0 {
+		var s *scenario
+		s, err = newScenario("", self.ConcurrentActions, self.ActionGraph)
+		if err != nil {
+			return
+		}
+		scenarios = []*scenario{s}
+		return
+	}
+	if len(self.ConcurrentActions) > 0 || self.ActionGraph != nil {
+		err = fmt.Errorf("a task with scenarios cannot have its own action-seq or action-graph")
+		return
+	}
+	names := make(map[string]bool, len(self.Scenarios))
+	for _, spec := range self.Scenarios {
+		var s *scenario
+		s, err = spec.getScenario()
+		if err != nil {
+			return
+		}
+		if names[s.name] {
+			err = fmt.Errorf("more than one scenario is named %v", s.name)
+			return
+		}
+		names[s.name] = true
+		scenarios = append(scenarios, s)
+	}
+	return
+}
+
+// pickScenario picks a scenario by weight.
+func pickScenario(scenarios []*scenario, rnd *rand.Rand) *scenario {
+	if len(scenarios) == 1 {
+		return scenarios[0]
+	}
+	total := 0.0
+	for _, s := range scenarios {
+		total += s.weight
+	}
+	x := rnd.Float64() * total
+	for _, s := range scenarios {
+		if x < s.weight {
+			return s
+		}
+		x -= s.weight
+	}
+	return scenarios[len(scenarios)-1]
+}
+
+// newIteration starts an iteration with a scenario.
+func (self *worker) newIteration() *iteration {
+	it := new(iteration)
+	it.scenario = pickScenario(self.scenarios, self.rnd)
+	return it
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestPickScenario(t *testing.T) {
+	scenarios := []*scenario{
+		&scenario{name: "browse", weight: 70},
+		&scenario{name: "search", weight: 25},
+		&scenario{name: "checkout", weight: 5},
+	}
+	count := func(seed int64) map[string]int {
+		rnd := rand.New(rand.NewSource(seed))
+		ret := make(map[string]int, len(scenarios))
+		for i := 0; i < 10000; i++ {
+			ret[pickScenario(scenarios, rnd).name]++
+		}
+		return ret
+	}
+	counts := count(42)
+	for _, s := range scenarios {
+		exp := int(s.weight * 100)
+		if n := counts[s.name]; n < exp*8/10 || n > exp*12/10 {
+			t.Errorf("%v is picked %v times, expected about %v", s.name, n, exp)
+		}
+	}
+	again := count(42)
+	for name, n := range counts {
+		if again[name] != n {
+			t.Errorf("The same seed should pick the same scenarios: %v != %v", counts, again)
+			break
+		}
+	}
+}
+
+// scenarioRecorder counts the requests of each scenario and checks that
+// they come from the actions of the scenario.
+type scenarioRecorder struct {
+	t         *testing.T
+	lock      sync.Mutex
+	scenarios map[string]int
+	closer
+}
+
+func (self *scenarioRecorder) ReadResponse(req *Request, env *Env) (resp *Response, updates *Env, err error) {
+	if req.Tag != req.Scenario {
+		self.t.Errorf("Action %v is run in scenario %v", req.Tag, req.Scenario)
+	}
+	self.lock.Lock()
+	self.scenarios[req.Scenario]++
+	self.lock.Unlock()
+	resp = &Response{Status: 200, Body: ioutil.NopCloser(strings.NewReader(""))}
+	return
+}
+
+func genScenario(name string, weight float64) *ScenarioSpec {
+	spec := &ActionSpec{
+		Tag:         name,
+		URLTemplate: "http://localhost/" + name,
+		Method:      "GET",
+	}
+	return &ScenarioSpec{
+		Name:   name,
+		Weight: weight,
+		ConcurrentActions: []*ConcurrentActions{
+			&ConcurrentActions{Actions: []*ActionSpec{spec}},
+		},
+	}
+}
+
+func TestScenarios(t *testing.T) {
+	StartWorkers(10)
+	defer StopAllWorkers()
+
+	run := func() map[string]int {
+		seed := int64(7)
+		taskSpec := new(TaskSpec)
+		taskSpec.Seed = &seed
+		taskSpec.Scenarios = []*ScenarioSpec{
+			genScenario("browse", 3),
+			genScenario("search", 1),
+		}
+		taskSpec.Load = &LoadSpec{
+			Rate:            2000,
+			Duration:        "10s",
+			MaxNrIterations: 200,
+		}
+		rr := &scenarioRecorder{t: t, scenarios: make(map[string]int, 2)}
+		runTask(t, taskSpec, rr)
+		return rr.scenarios
+	}
+	counts := run()
+	if len(counts) != 2 || counts["browse"]+counts["search"] != 200 {
+		t.Fatalf("Wrong requests: %v", counts)
+	}
+	if counts["browse"] < 120 || counts["browse"] > 180 {
+		t.Errorf("browse should run in about 75%% of the iterations: %v", counts)
+	}
+	if again := run(); again["browse"] != counts["browse"] {
+		t.Errorf("The same seed should pick the same scenarios: %v != %v", counts, again)
+	}
+}
+
+func TestSeedsOfRandomSources(t *testing.T) {
+	filename := writeFeederFile(t, "users.csv", usersCSV)
+	defer os.RemoveAll(filepath.Dir(filename))
+	seed := int64(7)
+	taskSpec := genSingleActionTask()
+	taskSpec.Seed = &seed
+	taskSpec.Feeders = []*FeederSpec{&FeederSpec{File: filename, Mode: "random"}}
+	exec, err := taskSpec.GetWorker(new(urlRecorder))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	w := exec.(*worker)
+	randInt := w.funcs["randInt"].(func(min, max int) (int, error))
+	const mask = 1<<62 - 1
+	f, _ := randInt(0, mask)
+	draws := map[string]int64{
+		"funcs":    int64(f),
+		"scenario": w.rnd.Int63() & mask,
+		"think":    w.thinkRnd.Int63() & mask,
+		"feeder":   w.feeders[0].rnd.Int63() & mask,
+	}
+	seen := make(map[int64]string, len(draws))
+	for name, v := range draws {
+		if other, ok := seen[v]; ok {
+			t.Errorf("%v and %v draw the same value %v", name, other, v)
+		}
+		seen[v] = name
+	}
+}
+
+func TestInvalidScenarios(t *testing.T) {
+	noName := genScenario("", 1)
+	noWeight := genScenario("browse", 0)
+	both := genScenario("browse", 1)
+	both.ActionGraph = &ActionGraph{Actions: []*ActionSpec{graphAction("a", "http://localhost/a", "")}}
+	tasks := []*TaskSpec{
+		&TaskSpec{Scenarios: []*ScenarioSpec{noName}},
+		&TaskSpec{Scenarios: []*ScenarioSpec{noWeight}},
+		&TaskSpec{Scenarios: []*ScenarioSpec{both}},
+		&TaskSpec{Scenarios: []*ScenarioSpec{genScenario("a", 1), genScenario("a", 2)}},
+		&TaskSpec{
+			ConcurrentActions: genSingleActionTask().ConcurrentActions,
+			Scenarios:         []*ScenarioSpec{genScenario("a", 1)},
+		},
+	}
+	for _, taskSpec := range tasks {
+		if _, err := taskSpec.GetWorker(new(graphResponseReader)); err == nil {
+			t.Errorf("Should be an error: %+v", taskSpec)
+		}
+	}
+}
+
+func TestTimerScenarios(t *testing.T) {
+	rr, logfile := newTestTimer(t, nil, &statusResponseReader{status: 200})
+	for _, scenario := range []string{"search", "browse", "browse"} {
+		req := &Request{Tag: "home", Scenario: scenario}
+		if _, _, err := rr.ReadResponse(req, nil); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+	summaries := rr.(LatencySummarizer).LatencySummaries()
+	rr.Close()
+
+	if len(summaries) != 2 {
+		t.Fatalf("Got %v summaries, instead of 2", len(summaries))
+	}
+	if summaries[0].Scenario != "browse" || summaries[0].Count != 2 ||
+		summaries[1].Scenario != "search" || summaries[1].Count != 1 {
+		t.Errorf("Wrong summaries: %+v %+v", summaries[0], summaries[1])
+	}
+	lines := readTimerLog(t, logfile)
+	if len(lines) != 3 || !strings.HasSuffix(lines[0], "\tScenariosearch") {
+		t.Errorf("Wrong log: %v", lines)
+	}
+}
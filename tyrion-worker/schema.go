@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// SchemaViolation is one place where a response does not follow the
+// schema. Pointer is the JSON pointer to the offending value. It is empty if
+// the violation is about the whole document.
+type SchemaViolation struct {
+	Pointer string `json:"pointer"`
+	Message string `json:"message"`
+}
+
+// SchemaError is reported when a response does not follow the schema of
+// its action.
+type SchemaError struct {
+	Tag        string             `json:"tag"`
+	URL        string             `json:"url"`
+	Env        *Env               `json:"env"`
+	Schema     string             `json:"schema"`
+	Violations []*SchemaViolation `json:"violations"`
+}
+
+func (self *SchemaError) Error() string {
+	msgs := make([]string, len(self.Violations))
+	for i, v := range self.Violations {
+		msgs[i] = fmt.Sprintf("%q: %v", v.Pointer, v.Message)
+	}
+	return fmt.Sprintf("Tag=%v URL=%v Env=%v: response does not follow schema %v: %v",
+		self.Tag, self.URL, self.Env, self.Schema, strings.Join(msgs, "; "))
+}
+
+type cachedSchema struct {
+	modTime time.Time
+	schema  *gojsonschema.Schema
+}
+
+// Actions are created for every environment, so the schemas are only
+// loaded again if their files have changed.
+var schemaCacheLock sync.Mutex
+var schemaCache map[string]*cachedSchema
+
+func init() {
+	schemaCache = make(map[string]*cachedSchema, 10)
+}
+
+// loadSchema reads the JSON schema in a local file.
+func loadSchema(filename string) (schema *gojsonschema.Schema, err error) {
+	path, err := filepath.Abs(filename)
+	if err != nil {
+		return
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		err = fmt.Errorf("unable to read schema %v: %v", filename, err)
+		return
+	}
+	schemaCacheLock.Lock()
+	defer schemaCacheLock.Unlock()
+	if c, ok := schemaCache[path]; ok && c.modTime.Equal(info.ModTime()) {
+		schema = c.schema
+		return
+	}
+	loader := gojsonschema.NewReferenceLoader("file://" + filepath.ToSlash(path))
+	schema, err = gojsonschema.NewSchema(loader)
+	if err != nil {
+		err = fmt.Errorf("%v is not a valid JSON schema: %v", filename, err)
+		return
+	}
+	schemaCache[path] = &cachedSchema{modTime: info.ModTime(), schema: schema}
+	return
+}
+
+// jsonPointer converts the context of a validation error, e.g.
+// (root).users.0.name, into a JSON pointer, e.g. /users/0/name.
+func jsonPointer(context *gojsonschema.JsonContext) string {
+	if context == nil {
+		return ""
+	}
+	return strings.TrimPrefix(context.String("/"), gojsonschema.STRING_CONTEXT_ROOT)
+}
+
+// validateBody returns the violations of the body against the schema.
+func validateBody(schema *gojsonschema.Schema, body []byte) []*SchemaViolation {
+	result, err := schema.Validate(gojsonschema.NewBytesLoader(body))
+	if err != nil {
+		return []*SchemaViolation{
+			&SchemaViolation{Message: fmt.Sprintf("response is not valid json: %v", err)},
+		}
+	}
+	if result.Valid() {
+		return nil
+	}
+	ret := make([]*SchemaViolation, 0, len(result.Errors()))
+	for _, e := range result.Errors() {
+		v := new(SchemaViolation)
+		v.Pointer = jsonPointer(e.Context())
+		v.Message = e.Description()
+		ret = append(ret, v)
+	}
+	return ret
+}
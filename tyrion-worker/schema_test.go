@@ -0,0 +1,102 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const userSchema = `{
+	"type": "object",
+	"properties": {
+		"user": {"type": "string"},
+		"friends": {
+			"type": "array",
+			"items": {"type": "object", "required": ["name"]}
+		}
+	},
+	"required": ["user"]
+}`
+
+func writeSchema(t *testing.T, schema string) string {
+	dir, err := ioutil.TempDir("", "tyrion-schema")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	filename := filepath.Join(dir, "schema.json")
+	err = ioutil.WriteFile(filename, []byte(schema), 0600)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	return filename
+}
+
+func TestSchemaValid(t *testing.T) {
+	schema := writeSchema(t, userSchema)
+	defer os.RemoveAll(filepath.Dir(schema))
+	_, err := performActionOnBody(t, &ActionSpec{RespSchema: schema}, `{"user": "monnand", "friends": [{"name": "alan"}]}`)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSchemaViolations(t *testing.T) {
+	schema := writeSchema(t, userSchema)
+	defer os.RemoveAll(filepath.Dir(schema))
+	_, err := performActionOnBody(t, &ActionSpec{RespSchema: schema}, `{"user": 1, "friends": [{"name": "alan"}, {}]}`)
+	serr, ok := err.(*SchemaError)
+	if !ok {
+		t.Fatalf("Should be a schema error: %v", err)
+	}
+	if serr.Tag != "sometag" || serr.Schema != schema {
+		t.Errorf("Wrong error: %+v", serr)
+	}
+	pointers := make(map[string]bool, len(serr.Violations))
+	for _, v := range serr.Violations {
+		pointers[v.Pointer] = true
+	}
+	for _, p := range []string{"/user", "/friends/1"} {
+		if !pointers[p] {
+			t.Errorf("Cannot find violation at %v: %v", p, err)
+		}
+	}
+
+	_, err = performActionOnBody(t, &ActionSpec{RespSchema: schema}, `not json`)
+	if _, ok := err.(*SchemaError); !ok {
+		t.Errorf("Should be a schema error: %v", err)
+	}
+}
+
+func TestSchemaCached(t *testing.T) {
+	schema := writeSchema(t, userSchema)
+	defer os.RemoveAll(filepath.Dir(schema))
+	s1, err := loadSchema(schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s2, err := loadSchema(schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s1 != s2 {
+		t.Errorf("The schema should be cached")
+	}
+}
+
+func TestInvalidSchema(t *testing.T) {
+	schema := writeSchema(t, `{"type": 1}`)
+	defer os.RemoveAll(filepath.Dir(schema))
+	for _, filename := range []string{schema, schema + ".missing"} {
+		as := &ActionSpec{
+			URLTemplate: "http://localhost:8080/",
+			Method:      "GET",
+			Tag:         "sometag",
+			RespSchema:  filename,
+		}
+		_, err := as.GetAction(nil)
+		if err == nil {
+			t.Errorf("%v should be invalid", filename)
+		}
+	}
+}
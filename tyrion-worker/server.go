@@ -22,8 +22,11 @@ func (self *TaskServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 type taskResult struct {
-	Errors []string `json:"errors,omitempty"`
-	Envs   []*Env   `json:"envs"`
+	Errors            []string          `json:"errors,omitempty"`
+	AssertionFailures []*AssertionError `json:"assertion-failures,omitempty"`
+	SchemaViolations  []*SchemaError    `json:"schema-violations,omitempty"`
+	Envs              []*Env            `json:"envs"`
+	Summaries         []*LatencySummary `json:"summaries,omitempty"`
 }
 
 func (self *TaskServer) ServeJson(w io.Writer, r io.Reader) {
@@ -50,6 +53,12 @@ func (self *TaskServer) ServeJson(w io.Writer, r io.Reader) {
 			if err != nil {
 				es := fmt.Sprintf("Error: %v\n", err)
 				tr.Errors = append(tr.Errors, es)
+				switch e := err.(type) {
+				case *AssertionError:
+					tr.AssertionFailures = append(tr.AssertionFailures, e)
+				case *SchemaError:
+					tr.SchemaViolations = append(tr.SchemaViolations, e)
+				}
 			}
 		}
 	}()
@@ -59,6 +68,9 @@ func (self *TaskServer) ServeJson(w io.Writer, r io.Reader) {
 		errChan <- err
 	} else {
 		envs = task.Execute(errChan)
+		if s, ok := task.(LatencySummarizer); ok {
+			tr.Summaries = s.LatencySummaries()
+		}
 	}
 	if finalizer != nil {
 		err = finalizer.FinalizeTask(&taskSpec, envs)
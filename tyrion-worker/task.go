@@ -3,7 +3,10 @@ package main
 import (
 	"fmt"
 	"io"
+	"math/rand"
 	"sync"
+	"text/template"
+	"time"
 
 	"github.com/kr/pretty"
 )
@@ -18,11 +21,30 @@ type TaskExecutor interface {
 	Execute(errChan chan<- error) []*Env
 }
 
+// If When is given, the actions only run for the environments which meet
+// the condition. The other environments are passed to the next step
+// unchanged. See condition for the syntax.
+//
+// A step may run more than once, each time with the environments produced
+// by the last time. It runs Repeat times, or, if Until is given, until
+// each environment meets the condition, e.g. {{.state}} == "done". The
+// environments which still do not meet it after MaxIterations (100 by
+// default) are reported as errors. Interval is the time to wait between
+// two iterations, e.g. 500ms.
+//
+// ThinkTime is the time to wait before the step starts. Like the think
+// time of an action, it is not part of the response time of the requests.
 type ConcurrentActions struct {
-	Actions             []*ActionSpec `json:"concurrent-actions"`
-	ProceedWhenNoUpdate bool          `json:"proceed-when-no-update,omitempty"`
-	Skip                bool          `json:"skip,omitempty"`
-	Debug               bool          `json:"debug,omitempty"`
+	Actions             []*ActionSpec  `json:"concurrent-actions"`
+	ProceedWhenNoUpdate bool           `json:"proceed-when-no-update,omitempty"`
+	Skip                bool           `json:"skip,omitempty"`
+	Debug               bool           `json:"debug,omitempty"`
+	When                string         `json:"when,omitempty"`
+	Repeat              int            `json:"repeat,omitempty"`
+	Until               string         `json:"until,omitempty"`
+	MaxIterations       int            `json:"max-iterations,omitempty"`
+	Interval            string         `json:"interval,omitempty"`
+	ThinkTime           *ThinkTimeSpec `json:"think-time,omitempty"`
 }
 
 type TaskSpec struct {
@@ -30,10 +52,69 @@ type TaskSpec struct {
 	ConcurrentActions []*ConcurrentActions `json:"action-seq"`
 	Plugins           []*PluginSpec        `json:"plugins,omitempty"`
 	Finalizers        []*TaskFinalizerSpec `json:"finally,omitempty"`
+	Load              *LoadSpec            `json:"load,omitempty"`
+	// The seed of the random functions in templates. A random seed is
+	// used if it is not given.
+	Seed *int64 `json:"seed,omitempty"`
+	// Each iteration takes one row from each feeder.
+	Feeders []*FeederSpec `json:"feeders,omitempty"`
+	// Used instead of the action sequence if it is given.
+	ActionGraph *ActionGraph `json:"action-graph,omitempty"`
+	// Used instead of the action sequence or graph if it is given. Each
+	// iteration runs one of the scenarios.
+	Scenarios []*ScenarioSpec `json:"scenarios,omitempty"`
+	// The minimum time between the starts of two iterations of a virtual
+	// user, e.g. 10s. It needs virtual users in the load.
+	Pacing string `json:"pacing,omitempty"`
 }
 
 func (self *TaskSpec) GetWorker(rr ResponseReader) (exec TaskExecutor, err error) {
 	ret := new(worker)
+	seed := time.Now().UnixNano()
+	if self.Seed != nil {
+		seed = *self.Seed
+	}
+	// Each random source has its own seed derived from the seed of the
+	// task, so that they do not draw the same values.
+	seeds := rand.New(rand.NewSource(seed))
+	ret.funcs = newTemplateFuncs(seeds.Int63())
+	ret.rnd = rand.New(&lockedSource{src: rand.NewSource(seeds.Int63())})
+	ret.thinkRnd = rand.New(&lockedSource{src: rand.NewSource(seeds.Int63())})
+	feederSeed := seeds.Int63()
+	if len(self.Feeders) > 0 {
+		rnd := rand.New(&lockedSource{src: rand.NewSource(feederSeed)})
+		for _, spec := range self.Feeders {
+			var f *feeder
+			f, err = spec.getFeeder(rnd)
+			if err != nil {
+				return
+			}
+			ret.feeders = append(ret.feeders, f)
+		}
+	}
+
+	if len(self.Pacing) > 0 {
+		if self.Load == nil || self.Load.VirtualUsers <= 0 {
+			err = fmt.Errorf("pacing needs virtual users in the load")
+			return
+		}
+		ret.pacing, err = time.ParseDuration(self.Pacing)
+		if err != nil {
+			err = fmt.Errorf("invalid pacing %v: %v", self.Pacing, err)
+			return
+		}
+	}
+	ret.scenarios, err = self.getScenarios()
+	if err != nil {
+		return
+	}
+
+	if self.Load != nil {
+		ret.load, err = self.Load.getGenerator()
+		if err != nil {
+			return
+		}
+	}
 
 	if rr == nil {
 		plugins := self.Plugins
@@ -78,6 +159,16 @@ type worker struct {
 	spec        *TaskSpec
 	rr          ResponseReader
 	closer      io.Closer
+	load        *loadGenerator
+	summaries   []*LatencySummary
+	funcs       template.FuncMap
+	feeders     []*feeder
+	scenarios   []*scenario
+	// Picks the scenarios.
+	rnd *rand.Rand
+	// Samples the think times.
+	thinkRnd *rand.Rand
+	pacing   time.Duration
 }
 
 type subTaskResult struct {
@@ -85,15 +176,32 @@ type subTaskResult struct {
 	forks []*Env
 }
 
+// iteration holds what is known about one walk through the action sequence.
+type iteration struct {
+	// The name of the load stage in which the iteration was started.
+	stage string
+	// When the iteration was supposed to start. Zero if it was not
+	// scheduled by the load generator.
+	start time.Time
+	// The scenario run by the iteration.
+	scenario *scenario
+	// The variables taken from the feeders, if any.
+	vars   *Env
+	leases []*feederLease
+}
+
 type subTask struct {
-	action  *Action
-	env     *Env
-	resChan chan<- *subTaskResult
+	action    *Action
+	env       *Env
+	it        *iteration
+	scheduled time.Time
+	think     time.Duration
+	resChan   chan<- *subTaskResult
 }
 
 func subTaskExecutor(taskChan <-chan *subTask) {
 	for st := range taskChan {
-		updates, err := st.action.Perform(st.env)
+		updates, err := st.action.perform(st.env, st.it, st.scheduled)
 		res := new(subTaskResult)
 		res.forks = st.env.Fork(updates...)
 		res.err = err
@@ -105,16 +213,43 @@ func (self *worker) Execute(errChan chan<- error) []*Env {
 	if self.closer != nil {
 		defer self.closer.Close()
 	}
-	envs := make([]*Env, 1)
-	envs[0] = self.spec.InitEnv
-	if envs[0].IsEmpty() {
-		envs = make([]*Env, 1, 10)
-		envs[0] = EmptyEnv()
+	var envs []*Env
+	if self.load != nil {
+		envs = self.executeLoad(errChan)
+	} else {
+		it := self.newIteration()
+		if self.feed(it) {
+			envs = self.executeIteration(it, errChan)
+			self.release(it)
+		} else {
+			errChan <- fmt.Errorf("feeders have no more rows")
+		}
+	}
+	if s, ok := self.rr.(LatencySummarizer); ok {
+		self.summaries = s.LatencySummaries()
+	}
+	return envs
+}
+
+// LatencySummaries returns the summaries collected from the plugins at the
+// end of the last execution.
+func (self *worker) LatencySummaries() []*LatencySummary {
+	return self.summaries
+}
+
+// executeIteration walks through the action sequence, or the action graph,
+// of the scenario of the iteration once. It may be called concurrently.
+func (self *worker) executeIteration(it *iteration, errChan chan<- error) []*Env {
+	envs := make([]*Env, 1, 10)
+	envs[0] = self.spec.InitEnv.Clone()
+	envs[0].Update(it.vars)
+	if it.scenario.graph != nil {
+		return self.executeGraph(it, envs[0], errChan)
 	}
 	var nilEnvs [1]*Env
 	nilEnvs[0] = EmptyEnv()
 
-	for _, concurrentActions := range self.spec.ConcurrentActions {
+	for i, concurrentActions := range it.scenario.seq {
 		if concurrentActions.Skip {
 			continue
 		}
@@ -125,41 +260,83 @@ func (self *worker) Execute(errChan chan<- error) []*Env {
 		if nrActions == 0 {
 			continue
 		}
-		resChan := make(chan *subTaskResult)
-		var wg sync.WaitGroup
-		wg.Add(1)
-		// reaper function
+		stageCond, err := newCondition(concurrentActions.When, self.funcs)
+		if err != nil {
+			errChan <- fmt.Errorf("Step %v has an invalid condition: %v", i, err)
+			envs = nil
+			break
+		}
+		loop, err := concurrentActions.getLoop(self.funcs)
+		if err != nil {
+			errChan <- fmt.Errorf("Step %v has an invalid loop: %v", i, err)
+			envs = nil
+			break
+		}
+		thinkTime, err := concurrentActions.ThinkTime.getThinkTime()
+		if err != nil {
+			errChan <- fmt.Errorf("Step %v has an invalid think time: %v", i, err)
+			envs = nil
+			break
+		}
+		think := thinkTime.sample(self.thinkRnd)
+
+		// Environments which do not meet the condition are passed to the
+		// next step as they are.
 		forks := make([]*Env, 0, len(envs)*3)
-		go func(n int) {
-			defer wg.Done()
-			for i := 0; i < n; i++ {
-				res := <-resChan
-				if res.err != nil {
-					errChan <- res.err
+		pending := make([]*Env, 0, len(envs))
+		for _, env := range envs {
+			run, err := stageCond.eval(env)
+			if err != nil {
+				errChan <- fmt.Errorf("Step %v: cannot evaluate %v: %v", i, stageCond.text, err)
+				continue
+			}
+			if run {
+				pending = append(pending, env)
+			} else {
+				forks = append(forks, env)
+			}
+		}
+
+		for n := 1; len(pending) > 0; n++ {
+			if n > 1 {
+				time.Sleep(loop.interval)
+			} else {
+				time.Sleep(think)
+			}
+			// All actions in this step are supposed to start now. Any
+			// time spent waiting for a free worker is part of their
+			// response time.
+			scheduled := time.Now()
+			if i == 0 && n == 1 && !it.start.IsZero() {
+				scheduled = it.start.Add(think)
+			}
+			results := self.executeStage(concurrentActions, pending, it, scheduled, errChan)
+			if loop.until == nil {
+				if n < loop.repeat {
+					pending = results
 					continue
 				}
-				forks = append(forks, res.forks...)
-				forks = uniqEnvs(forks...)
+				forks = append(forks, results...)
+				break
 			}
-		}(nrActions * len(envs))
-
-		for _, env := range envs {
-			for _, spec := range concurrentActions.Actions {
-				action, err := spec.GetAction(self.rr)
+			pending = make([]*Env, 0, len(results))
+			for _, env := range results {
+				done, err := loop.until.eval(env)
 				if err != nil {
-					res := new(subTaskResult)
-					res.err = fmt.Errorf("Action %v is invalid: %v", spec.Tag, err)
-					resChan <- res
+					errChan <- fmt.Errorf("Step %v: cannot evaluate %v: %v", i, loop.until.text, err)
 					continue
 				}
-				st := new(subTask)
-				st.action = action
-				st.env = env
-				st.resChan = resChan
-				self.subTaskChan <- st
+				if done {
+					forks = append(forks, env)
+				} else if n >= loop.max {
+					errChan <- fmt.Errorf("Step %v: Env=%v: %v does not hold after %v iterations", i, env, loop.until.text, n)
+				} else {
+					pending = append(pending, env)
+				}
 			}
 		}
-		wg.Wait()
+		forks = uniqEnvs(forks...)
+
 		if len(forks) == 0 && !concurrentActions.ProceedWhenNoUpdate {
 			break
 		}
@@ -170,3 +347,86 @@ func (self *worker) Execute(errChan chan<- error) []*Env {
 	}
 	return envs
 }
+
+// executeStage runs the actions of a step once for each environment and
+// returns the environments they produce. Environments for which no action
+// runs are returned as they are.
+func (self *worker) executeStage(concurrentActions *ConcurrentActions, envs []*Env, it *iteration, scheduled time.Time, errChan chan<- error) []*Env {
+	nrActions := len(concurrentActions.Actions)
+	passed := make([]*Env, 0, len(envs))
+	tasks := make([]*subTask, 0, nrActions*len(envs))
+	failed := make([]*subTaskResult, 0, 1)
+	for _, env := range envs {
+		handled := false
+		for _, spec := range concurrentActions.Actions {
+			action, err := spec.getAction(self.rr, self.funcs)
+			if err != nil {
+				res := new(subTaskResult)
+				res.err = fmt.Errorf("Action %v is invalid: %v", spec.Tag, err)
+				failed = append(failed, res)
+				handled = true
+				continue
+			}
+			run, err := action.When.eval(env)
+			if err != nil {
+				res := new(subTaskResult)
+				res.err = fmt.Errorf("Action %v: cannot evaluate %v: %v", spec.Tag, action.When.text, err)
+				failed = append(failed, res)
+				handled = true
+				continue
+			}
+			if !run {
+				continue
+			}
+			st := new(subTask)
+			st.action = action
+			st.env = env
+			st.it = it
+			st.scheduled = scheduled
+			st.think = action.ThinkTime.sample(self.thinkRnd)
+			tasks = append(tasks, st)
+			handled = true
+		}
+		if !handled {
+			passed = append(passed, env)
+		}
+	}
+
+	resChan := make(chan *subTaskResult)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	// reaper function
+	forks := make([]*Env, 0, len(envs)*3)
+	forks = append(forks, passed...)
+	go func(n int) {
+		defer wg.Done()
+		for i := 0; i < n; i++ {
+			res := <-resChan
+			if res.err != nil {
+				errChan <- res.err
+				continue
+			}
+			forks = append(forks, res.forks...)
+			forks = uniqEnvs(forks...)
+		}
+	}(len(tasks) + len(failed))
+
+	for _, res := range failed {
+		resChan <- res
+	}
+	for _, st := range tasks {
+		st.resChan = resChan
+		if st.think <= 0 {
+			self.subTaskChan <- st
+			continue
+		}
+		// Think without holding a worker.
+		go func(st *subTask) {
+			time.Sleep(st.think)
+			st.scheduled = st.scheduled.Add(st.think)
+			self.subTaskChan <- st
+		}(st)
+	}
+	wg.Wait()
+	return forks
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// ThinkTimeSpec describes a random delay, like the time a user takes to
+// read a page before clicking a link. Type can be one of:
+//
+// - fixed: Always Duration.
+// - uniform: Uniformly distributed within [Min, Max].
+// - normal: Normally distributed with Mean and StdDev.
+// - exponential: Exponentially distributed with Mean.
+//
+// The durations are strings like 500ms. The delays of normal and
+// exponential are limited to [Min, Max] if they are given, and are never
+// negative.
+type ThinkTimeSpec struct {
+	Type     string `json:"type"`
+	Duration string `json:"duration,omitempty"`
+	Min      string `json:"min,omitempty"`
+	Max      string `json:"max,omitempty"`
+	Mean     string `json:"mean,omitempty"`
+	StdDev   string `json:"std-dev,omitempty"`
+}
+
+type thinkTime struct {
+	typ      string
+	duration time.Duration
+	min      time.Duration
+	max      time.Duration
+	mean     time.Duration
+	stdDev   time.Duration
+}
+
+func parseThinkDuration(typ, name, value string, required bool) (d time.Duration, err error) {
+	if len(value) == 0 {
+		if required {
+			err = fmt.Errorf("%v think time needs %v", typ, name)
+		}
+		return
+	}
+	d, err = time.ParseDuration(value)
+	if err != nil {
+		err = fmt.Errorf("%v think time has invalid %v %v: %v", typ, name, value, err)
+		return
+	}
+	if d < 0 {
+		err = fmt.Errorf("%v think time has negative %v %v", typ, name, value)
+	}
+	return
+}
+
+// getThinkTime returns nil if the spec is nil.
+func (self *ThinkTimeSpec) getThinkTime() (t *thinkTime, err error) {
+	if self == nil {
+		return
+	}
+	ret := new(thinkTime)
+	ret.typ = self.Type
+	needDuration := false
+	needRange := false
+	needMean := false
+	needStdDev := false
+	switch self.Type {
+	case "fixed":
+		needDuration = true
+	case "uniform":
+		needRange = true
+	case "normal":
+		needMean = true
+		needStdDev = true
+	case "exponential":
+		needMean = true
+	default:
+		err = fmt.Errorf("Unknown think time type: %v", self.Type)
+		return
+	}
+	ret.duration, err = parseThinkDuration(self.Type, "duration", self.Duration, needDuration)
+	if err != nil {
+		return
+	}
+	ret.min, err = parseThinkDuration(self.Type, "min", self.Min, needRange)
+	if err != nil {
+		return
+	}
+	ret.max, err = parseThinkDuration(self.Type, "max", self.Max, needRange)
+	if err != nil {
+		return
+	}
+	ret.mean, err = parseThinkDuration(self.Type, "mean", self.Mean, needMean)
+	if err != nil {
+		return
+	}
+	ret.stdDev, err = parseThinkDuration(self.Type, "std-dev", self.StdDev, needStdDev)
+	if err != nil {
+		return
+	}
+	if len(self.Max) > 0 && ret.max < ret.min {
+		err = fmt.Errorf("%v think time has max %v less than min %v", self.Type, self.Max, self.Min)
+		return
+	}
+	t = ret
+	return
+}
+
+func (self *thinkTime) limit(d time.Duration) time.Duration {
+	if d < self.min {
+		d = self.min
+	}
+	if self.max > 0 && d > self.max {
+		d = self.max
+	}
+	return d
+}
+
+// sample returns a delay drawn from the distribution. It returns 0 if the
+// think time is nil.
+func (self *thinkTime) sample(rnd *rand.Rand) time.Duration {
+	if self == nil {
+		return 0
+	}
+	switch self.typ {
+	case "fixed":
+		return self.duration
+	case "uniform":
+		return self.min + time.Duration(rnd.Int63n(int64(self.max-self.min)+1))
+	case "normal":
+		return self.limit(self.mean + time.Duration(rnd.NormFloat64()*float64(self.stdDev)))
+	case "exponential":
+		return self.limit(time.Duration(rnd.ExpFloat64() * float64(self.mean)))
+	}
+	return 0
+}
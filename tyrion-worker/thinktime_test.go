@@ -0,0 +1,117 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func sampleThinkTime(t *testing.T, spec *ThinkTimeSpec, n int) (samples []time.Duration, mean time.Duration) {
+	tt, err := spec.getThinkTime()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	rnd := rand.New(rand.NewSource(1))
+	var sum time.Duration
+	for i := 0; i < n; i++ {
+		d := tt.sample(rnd)
+		samples = append(samples, d)
+		sum += d
+	}
+	mean = sum / time.Duration(n)
+	return
+}
+
+func TestThinkTimeDistributions(t *testing.T) {
+	samples, _ := sampleThinkTime(t, &ThinkTimeSpec{Type: "fixed", Duration: "1s"}, 10)
+	for _, d := range samples {
+		if d != time.Second {
+			t.Errorf("fixed think time is %v, not 1s", d)
+		}
+	}
+
+	samples, mean := sampleThinkTime(t, &ThinkTimeSpec{Type: "uniform", Min: "1s", Max: "3s"}, 10000)
+	for _, d := range samples {
+		if d < time.Second || d > 3*time.Second {
+			t.Errorf("uniform think time %v is not in [1s, 3s]", d)
+		}
+	}
+	if mean < 1900*time.Millisecond || mean > 2100*time.Millisecond {
+		t.Errorf("Mean of uniform think time is %v, not about 2s", mean)
+	}
+
+	_, mean = sampleThinkTime(t, &ThinkTimeSpec{Type: "normal", Mean: "2s", StdDev: "200ms"}, 10000)
+	if mean < 1950*time.Millisecond || mean > 2050*time.Millisecond {
+		t.Errorf("Mean of normal think time is %v, not about 2s", mean)
+	}
+
+	_, mean = sampleThinkTime(t, &ThinkTimeSpec{Type: "exponential", Mean: "2s"}, 10000)
+	if mean < 1900*time.Millisecond || mean > 2100*time.Millisecond {
+		t.Errorf("Mean of exponential think time is %v, not about 2s", mean)
+	}
+
+	samples, _ = sampleThinkTime(t, &ThinkTimeSpec{Type: "normal", Mean: "0s", StdDev: "1s", Max: "500ms"}, 1000)
+	for _, d := range samples {
+		if d < 0 || d > 500*time.Millisecond {
+			t.Errorf("normal think time %v is not in [0, 500ms]", d)
+		}
+	}
+
+	var nilThinkTime *thinkTime
+	if d := nilThinkTime.sample(nil); d != 0 {
+		t.Errorf("nil think time is %v", d)
+	}
+}
+
+func TestInvalidThinkTimes(t *testing.T) {
+	specs := []*ThinkTimeSpec{
+		&ThinkTimeSpec{Type: "gamma", Mean: "1s"},
+		&ThinkTimeSpec{Type: "fixed"},
+		&ThinkTimeSpec{Type: "fixed", Duration: "soon"},
+		&ThinkTimeSpec{Type: "fixed", Duration: "-1s"},
+		&ThinkTimeSpec{Type: "uniform", Min: "1s"},
+		&ThinkTimeSpec{Type: "uniform", Min: "2s", Max: "1s"},
+		&ThinkTimeSpec{Type: "normal", Mean: "1s"},
+		&ThinkTimeSpec{Type: "exponential"},
+	}
+	for _, spec := range specs {
+		if _, err := spec.getThinkTime(); err == nil {
+			t.Errorf("Should be an error: %+v", spec)
+		}
+	}
+}
+
+func TestThinkTimeExcludedFromResponseTime(t *testing.T) {
+	StartWorkers(4)
+	defer StopAllWorkers()
+
+	taskSpec := genSingleActionTask()
+	taskSpec.ConcurrentActions[0].ThinkTime = &ThinkTimeSpec{Type: "fixed", Duration: "100ms"}
+	second := &ActionSpec{
+		Tag:         "ping",
+		URLTemplate: "http://localhost/ping",
+		Method:      "GET",
+		ThinkTime:   &ThinkTimeSpec{Type: "fixed", Duration: "100ms"},
+	}
+	taskSpec.ConcurrentActions = append(taskSpec.ConcurrentActions, &ConcurrentActions{
+		Actions:             []*ActionSpec{second},
+		ProceedWhenNoUpdate: true,
+	})
+	taskSpec.ConcurrentActions[0].ProceedWhenNoUpdate = true
+	rr, logfile := newTestTimer(t, nil, &statusResponseReader{status: 200})
+	defer readTimerLog(t, logfile)
+	defer rr.Close()
+
+	start := time.Now()
+	runTask(t, taskSpec, rr)
+	if d := time.Since(start); d < 200*time.Millisecond {
+		t.Errorf("Should think for 200ms, but took %v", d)
+	}
+	summaries := rr.(LatencySummarizer).LatencySummaries()
+	if len(summaries) != 1 || summaries[0].Count != 2 {
+		t.Fatalf("Wrong summaries: %+v", summaries)
+	}
+	if max := time.Duration(summaries[0].ResponseTime.Max); max >= 50*time.Millisecond {
+		t.Errorf("Response time should not include think time: %v", max)
+	}
+}
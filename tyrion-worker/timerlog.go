@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// timerRecord is what the timer logs about one request. Its json tags are
+// the schema of the structured log formats: they are the keys in jsonl and
+// the header of csv. Latencies are in nanoseconds. The phases of the request
+// are zero unless the http plugin traces it.
+type timerRecord struct {
+	Timestamp     string `json:"timestamp"`
+	Tag           string `json:"tag"`
+	Method        string `json:"method"`
+	URL           string `json:"url"`
+	Status        int    `json:"status"`
+	Protocol      string `json:"protocol"`
+	Latency       int64  `json:"latency-ns"`
+	ResponseTime  int64  `json:"response-time-ns"`
+	BytesSent     int64  `json:"bytes-sent"`
+	BytesReceived int64  `json:"bytes-received"`
+	Outcome       string `json:"outcome"`
+	Error         string `json:"error"`
+	Stage         string `json:"stage"`
+	Scenario      string `json:"scenario"`
+	DNSLookup     int64  `json:"dns-lookup-ns"`
+	Connect       int64  `json:"connect-ns"`
+	TLSHandshake  int64  `json:"tls-handshake-ns"`
+	FirstByte     int64  `json:"first-byte-ns"`
+	Transfer      int64  `json:"transfer-ns"`
+
+	start time.Time
+}
+
+func timerSchema() []string {
+	t := reflect.TypeOf(timerRecord{})
+	ret := make([]string, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		if name := t.Field(i).Tag.Get("json"); len(name) > 0 {
+			ret = append(ret, name)
+		}
+	}
+	return ret
+}
+
+func (self *timerRecord) values() []string {
+	v := reflect.ValueOf(self).Elem()
+	t := v.Type()
+	ret := make([]string, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		if len(t.Field(i).Tag.Get("json")) > 0 {
+			ret = append(ret, fmt.Sprint(v.Field(i).Interface()))
+		}
+	}
+	return ret
+}
+
+type timerLogWriter interface {
+	write(r *timerRecord) error
+}
+
+func newTimerLogWriter(format string, out *os.File) (w timerLogWriter, err error) {
+	switch format {
+	case "", "tsv":
+		w = &tsvTimerLogWriter{out: out}
+	case "jsonl":
+		w = &jsonlTimerLogWriter{out: out}
+	case "csv":
+		var info os.FileInfo
+		info, err = out.Stat()
+		if err != nil {
+			return
+		}
+		ret := &csvTimerLogWriter{out: csv.NewWriter(out)}
+		// Only write the header into a new file.
+		if info.Size() == 0 {
+			err = ret.writeRow(timerSchema())
+			if err != nil {
+				return
+			}
+		}
+		w = ret
+	default:
+		err = fmt.Errorf("timer: unknown format %v", format)
+	}
+	return
+}
+
+// The original format. Failed requests are not logged.
+type tsvTimerLogWriter struct {
+	out io.Writer
+}
+
+func (self *tsvTimerLogWriter) write(r *timerRecord) error {
+	if len(r.Error) > 0 {
+		return nil
+	}
+	delta := time.Duration(r.Latency)
+	respTime := time.Duration(r.ResponseTime)
+	line := fmt.Sprintf("[%v]\t%v\t%v\t%v\tStatus%v\t%v\t%v", r.start, r.Tag, r.Latency, delta, r.Status, r.ResponseTime, respTime)
+	if len(r.Stage) > 0 {
+		line += "\tStage" + r.Stage
+	}
+	if len(r.Scenario) > 0 {
+		line += "\tScenario" + r.Scenario
+	}
+	_, err := fmt.Fprintln(self.out, line)
+	return err
+}
+
+type jsonlTimerLogWriter struct {
+	out io.Writer
+}
+
+func (self *jsonlTimerLogWriter) write(r *timerRecord) error {
+	buf, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	buf = append(buf, '\n')
+	_, err = self.out.Write(buf)
+	return err
+}
+
+type csvTimerLogWriter struct {
+	out  *csv.Writer
+	lock sync.Mutex
+}
+
+func (self *csvTimerLogWriter) writeRow(row []string) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	err := self.out.Write(row)
+	if err != nil {
+		return err
+	}
+	self.out.Flush()
+	return self.out.Error()
+}
+
+func (self *csvTimerLogWriter) write(r *timerRecord) error {
+	return self.writeRow(r.values())
+}
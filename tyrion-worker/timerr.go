@@ -1,8 +1,11 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"regexp"
 	"time"
@@ -22,39 +25,121 @@ func (self *TimerResponseReaderFactory) String() string {
 func (self *TimerResponseReaderFactory) NewPlugin(params map[string]string, rest ResponseReader) (rr ResponseReader, err error) {
 	ret := new(TimerResponseReader)
 	if filename, ok := params["log"]; ok {
-		ret.out, err = os.OpenFile(filename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		var f *os.File
+		f, err = os.OpenFile(filename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
 		if err != nil {
 			return
 		}
+		ret.out = f
+		ret.log, err = newTimerLogWriter(params["format"], f)
+		if err != nil {
+			f.Close()
+			return
+		}
 	} else {
 		err = fmt.Errorf("timer needs a filename to take logs")
 		return
 	}
+	if filename, ok := params["summary"]; ok {
+		ret.summary, err = os.Create(filename)
+		if err != nil {
+			return
+		}
+	}
 	if tagp, ok := params["tag"]; ok {
 		ret.tagPattern, err = regexp.Compile(tagp)
 		if err != nil {
 			return
 		}
 	}
+	ret.latencies = newLatencyRecorder()
 	ret.rest = rest
 	rr = ret
 	return
 }
 
+// TimerResponseReader logs one record per request. The format parameter
+// decides how the records look like:
+//
+// - tsv: The default. Failed requests are not logged. Each line is
+//
+// [start time]	tag	service time in ns	service time	Status<code>	response time in ns	response time
+//
+// followed by Stage<name> if the request was sent in a load stage, and by
+// Scenario<name> if the task has scenarios.
+//
+// - jsonl: One json object per line. See timerRecord for the keys.
+//
+// - csv: Comma separated values. A header with the names of the fields is
+// written if the log file is empty.
+//
+// The service time (latency) is measured from when the request was actually
+// sent until the whole body is received. The response time is measured from
+// when the request was scheduled, so it includes the time the request spent
+// waiting for a free worker.
+//
+// The latencies are also kept in histograms for each tag in each scenario.
+// The tags are those of the actions before they are executed, so that
+// get-{{.user}} has one pair of histograms for all users. If the summary
+// parameter is given, the summaries are written into that file in json
+// when the timer is closed. The summaries also count the responses which
+// failed the assertions of their actions.
 type TimerResponseReader struct {
 	rest       ResponseReader
 	out        io.WriteCloser
+	log        timerLogWriter
+	summary    io.WriteCloser
 	tagPattern *regexp.Regexp
+	latencies  *latencyRecorder
+}
+
+func (self *TimerResponseReader) LatencySummaries() []*LatencySummary {
+	return self.latencies.summaries()
+}
+
+func (self *TimerResponseReader) RecordAssertionFailure(req *Request, err *AssertionError) {
+	if self.tagPattern != nil && len(self.tagPattern.FindString(req.Tag)) == 0 {
+		return
+	}
+	self.latencies.recordAssertionFailure(req.Scenario, summaryTag(req))
+}
+
+// summaryTag returns the tag by which the latencies of the request are
+// summarized.
+func summaryTag(req *Request) string {
+	if len(req.TagTemplate) > 0 {
+		return req.TagTemplate
+	}
+	return req.Tag
+}
+
+func (self *TimerResponseReader) writeSummary() error {
+	defer self.summary.Close()
+	buf, err := json.MarshalIndent(self.LatencySummaries(), "", "    ")
+	if err != nil {
+		return fmt.Errorf("timer: unable to marshal the summary: %v", err)
+	}
+	_, err = self.summary.Write(buf)
+	if err != nil {
+		return fmt.Errorf("timer: unable to write the summary: %v", err)
+	}
+	return nil
 }
 
 func (self *TimerResponseReader) Close() error {
+	var err error
 	if self.out != nil {
 		self.out.Close()
 	}
+	if self.summary != nil {
+		err = self.writeSummary()
+	}
 	if self.rest != nil {
-		return self.rest.Close()
+		if e := self.rest.Close(); err == nil {
+			err = e
+		}
 	}
-	return nil
+	return err
 }
 
 func (self *TimerResponseReader) ReadResponse(req *Request, env *Env) (resp *Response, updates *Env, err error) {
@@ -66,18 +151,62 @@ func (self *TimerResponseReader) ReadResponse(req *Request, env *Env) (resp *Res
 			return
 		}
 	}
-	var delta time.Duration
+	if self.rest == nil {
+		return
+	}
 	start := time.Now()
-	if self.rest != nil {
-		resp, updates, err = self.rest.ReadResponse(req, env)
-		delta = time.Now().Sub(start)
-		if err != nil {
-			return
-		}
-		if self.out == nil {
-			return
+	resp, updates, err = self.rest.ReadResponse(req, env)
+	var received int64
+	if err == nil && resp != nil && resp.Body != nil {
+		// Read the whole body so that the latency covers it.
+		var body []byte
+		body, err = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		received = int64(len(body))
+		resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	end := time.Now()
+	delta := end.Sub(start)
+	// The service time only covers the request itself, while the
+	// response time also includes the time the request spent
+	// waiting to be sent.
+	respTime := delta
+	if !req.Scheduled.IsZero() {
+		respTime = end.Sub(req.Scheduled)
+	}
+	self.latencies.record(req.Scenario, summaryTag(req), resp, err, delta, respTime)
+	if self.log == nil {
+		return
+	}
+
+	r := &timerRecord{
+		Timestamp:     start.Format(time.RFC3339Nano),
+		Tag:           req.Tag,
+		Method:        req.Method,
+		URL:           req.FullURL(),
+		Latency:       delta.Nanoseconds(),
+		ResponseTime:  respTime.Nanoseconds(),
+		BytesReceived: received,
+		Stage:         req.Stage,
+		Scenario:      req.Scenario,
+		Outcome:       getOutcome(resp, err),
+		start:         start,
+	}
+	if resp != nil {
+		r.Status = resp.Status
+		r.Protocol = resp.Proto
+		r.BytesSent = resp.BytesSent
+		if p := resp.Phases; p != nil {
+			r.DNSLookup = p.DNSLookup.Nanoseconds()
+			r.Connect = p.Connect.Nanoseconds()
+			r.TLSHandshake = p.TLSHandshake.Nanoseconds()
+			r.FirstByte = p.FirstByte.Nanoseconds()
+			r.Transfer = p.Transfer.Nanoseconds()
 		}
-		fmt.Fprintf(self.out, "[%v]\t%v\t%v\t%v\tStatus%v\n", start, req.Tag, delta.Nanoseconds(), delta, resp.Status)
 	}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	self.log.write(r)
 	return
 }
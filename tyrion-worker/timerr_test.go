@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+type sleepResponseReader struct {
+	d time.Duration
+	closer
+}
+
+func (self *sleepResponseReader) ReadResponse(req *Request, env *Env) (resp *Response, updates *Env, err error) {
+	time.Sleep(self.d)
+	resp = &Response{Status: 200}
+	return
+}
+
+func newTestTimer(t *testing.T, params map[string]string, rest ResponseReader) (rr ResponseReader, logfile string) {
+	dir, err := ioutil.TempDir("", "tyrion-timer")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	logfile = filepath.Join(dir, "timer.log")
+	if params == nil {
+		params = make(map[string]string, 1)
+	}
+	params["log"] = logfile
+	factory := &TimerResponseReaderFactory{}
+	rr, err = factory.NewPlugin(params, rest)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	return
+}
+
+func readTimerLog(t *testing.T, logfile string) []string {
+	defer os.RemoveAll(filepath.Dir(logfile))
+	d, err := ioutil.ReadFile(logfile)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	return strings.Split(strings.TrimSpace(string(d)), "\n")
+}
+
+func TestTimerResponseTimeIncludesQueueing(t *testing.T) {
+	rr, logfile := newTestTimer(t, nil, &sleepResponseReader{d: 10 * time.Millisecond})
+	req := &Request{
+		Tag:       "queued",
+		Stage:     "hold",
+		Scheduled: time.Now().Add(-time.Second),
+	}
+	_, _, err := rr.ReadResponse(req, nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	rr.Close()
+
+	lines := readTimerLog(t, logfile)
+	if len(lines) != 1 {
+		t.Fatalf("%v lines in the log", len(lines))
+	}
+	fields := strings.Split(lines[0], "\t")
+	if len(fields) != 8 {
+		t.Fatalf("Wrong format: %v", lines[0])
+	}
+	if fields[1] != "queued" || fields[4] != "Status200" || fields[7] != "Stagehold" {
+		t.Errorf("Wrong format: %v", lines[0])
+	}
+	service, _ := strconv.ParseInt(fields[2], 10, 64)
+	response, _ := strconv.ParseInt(fields[5], 10, 64)
+	if time.Duration(service) < 10*time.Millisecond || time.Duration(service) > 500*time.Millisecond {
+		t.Errorf("Service time should be about 10ms: %v", time.Duration(service))
+	}
+	if time.Duration(response) < time.Second {
+		t.Errorf("Response time should include queueing: %v", time.Duration(response))
+	}
+}
+
+type statusResponseReader struct {
+	status int
+	closer
+}
+
+func (self *statusResponseReader) ReadResponse(req *Request, env *Env) (resp *Response, updates *Env, err error) {
+	resp = &Response{Status: self.status}
+	return
+}
+
+func TestTimerLatencySummaries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tyrion-timer")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	summaryFile := filepath.Join(dir, "summary.json")
+	specs := []*PluginSpec{
+		&PluginSpec{
+			Name: "timer",
+			URLQuery: map[string]string{
+				"log":     filepath.Join(dir, "timer.log"),
+				"summary": summaryFile,
+			},
+		},
+	}
+	chain, err := NewPluginChain(specs)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	// Put a response reader at the end of the chain by hand.
+	timer := chain.(*pluginTagFilter).plugin.(*TimerResponseReader)
+	timer.rest = &statusResponseReader{status: 200}
+	for i := 0; i < 10; i++ {
+		chain.ReadResponse(&Request{Tag: "ok"}, nil)
+	}
+	timer.rest = &statusResponseReader{status: 503}
+	for i := 0; i < 3; i++ {
+		chain.ReadResponse(&Request{Tag: "failed"}, nil)
+	}
+
+	summaries := chain.(LatencySummarizer).LatencySummaries()
+	if len(summaries) != 2 {
+		t.Fatalf("%v summaries, not 2", len(summaries))
+	}
+	if summaries[0].Tag != "failed" || summaries[0].Count != 3 || summaries[0].Errors != 3 {
+		t.Errorf("Wrong summary: %+v", summaries[0])
+	}
+	if summaries[1].Tag != "ok" || summaries[1].Count != 10 || summaries[1].Errors != 0 {
+		t.Errorf("Wrong summary: %+v", summaries[1])
+	}
+	p := summaries[1].ServiceTime
+	if p.P50 > p.P90 || p.P90 > p.P99 || p.P99 > p.P999 || p.P999 > p.Max {
+		t.Errorf("Percentiles are not ordered: %+v", p)
+	}
+
+	err = chain.Close()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	d, err := ioutil.ReadFile(summaryFile)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	var written []*LatencySummary
+	err = json.Unmarshal(d, &written)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if len(written) != 2 || written[1].Count != 10 {
+		t.Errorf("Wrong summary file: %v", string(d))
+	}
+}
+
+type bodyResponseReader struct {
+	body string
+	closer
+}
+
+func (self *bodyResponseReader) ReadResponse(req *Request, env *Env) (resp *Response, updates *Env, err error) {
+	resp = &Response{
+		Status:    201,
+		Body:      ioutil.NopCloser(strings.NewReader(self.body)),
+		BytesSent: 42,
+	}
+	return
+}
+
+func testTimerRequest() *Request {
+	params := url.Values{}
+	params.Set("user", "monnand")
+	return &Request{
+		Tag:      "create",
+		URL:      "http://localhost/user",
+		Method:   "POST",
+		URLQuery: params,
+		Stage:    "hold",
+	}
+}
+
+func TestTimerJsonlFormat(t *testing.T) {
+	params := map[string]string{"format": "jsonl"}
+	rr, logfile := newTestTimer(t, params, &bodyResponseReader{body: "hello"})
+	resp, _, err := rr.ReadResponse(testTimerRequest(), nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	d, _ := ioutil.ReadAll(resp.Body)
+	if string(d) != "hello" {
+		t.Errorf("Body should still be readable: %v", string(d))
+	}
+	rr.Close()
+
+	lines := readTimerLog(t, logfile)
+	if len(lines) != 1 {
+		t.Fatalf("%v lines in the log", len(lines))
+	}
+	var r map[string]interface{}
+	err = json.Unmarshal([]byte(lines[0]), &r)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if len(r) != len(timerSchema()) {
+		t.Errorf("Should have %v fields: %v", len(timerSchema()), lines[0])
+	}
+	if _, err := time.Parse(time.RFC3339Nano, r["timestamp"].(string)); err != nil {
+		t.Errorf("Invalid timestamp: %v", err)
+	}
+	if r["url"] != "http://localhost/user?user=monnand" ||
+		r["method"] != "POST" ||
+		r["status"] != 201.0 ||
+		r["bytes-sent"] != 42.0 ||
+		r["bytes-received"] != 5.0 ||
+		r["stage"] != "hold" {
+		t.Errorf("Wrong record: %v", lines[0])
+	}
+}
+
+func TestTimerCsvFormat(t *testing.T) {
+	params := map[string]string{"format": "csv"}
+	rr, logfile := newTestTimer(t, params, &bodyResponseReader{body: "hello"})
+	rr.ReadResponse(testTimerRequest(), nil)
+	rr.ReadResponse(testTimerRequest(), nil)
+	rr.Close()
+
+	d, err := ioutil.ReadFile(logfile)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer os.RemoveAll(filepath.Dir(logfile))
+	records, err := csv.NewReader(bytes.NewReader(d)).ReadAll()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if len(records) != 3 {
+		t.Fatalf("%v records, should be a header and two rows", len(records))
+	}
+	header := strings.Join(records[0], ",")
+	if header != strings.Join(timerSchema(), ",") {
+		t.Errorf("Wrong header: %v", header)
+	}
+	if records[1][1] != "create" || records[1][4] != "201" {
+		t.Errorf("Wrong record: %v", records[1])
+	}
+}
+
+func TestTimerUnknownFormat(t *testing.T) {
+	factory := &TimerResponseReaderFactory{}
+	dir, err := ioutil.TempDir("", "tyrion-timer")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	params := map[string]string{
+		"log":    filepath.Join(dir, "timer.log"),
+		"format": "xml",
+	}
+	_, err = factory.NewPlugin(params, nil)
+	if err == nil {
+		t.Errorf("xml should be an unknown format")
+	}
+}
+
+type timeoutResponseReader struct {
+	closer
+}
+
+func (self *timeoutResponseReader) ReadResponse(req *Request, env *Env) (resp *Response, updates *Env, err error) {
+	err = &TimeoutError{Phase: "connect", Err: fmt.Errorf("i/o timeout")}
+	return
+}
+
+func TestTimerCountsTimeouts(t *testing.T) {
+	params := map[string]string{"format": "jsonl"}
+	rr, logfile := newTestTimer(t, params, &timeoutResponseReader{})
+	_, _, err := rr.ReadResponse(&Request{Tag: "timeout"}, nil)
+	if err == nil {
+		t.Errorf("Should be an error")
+	}
+	summaries := rr.(LatencySummarizer).LatencySummaries()
+	rr.Close()
+	if len(summaries) != 1 || summaries[0].Timeouts != 1 || summaries[0].Errors != 1 {
+		t.Errorf("Wrong summaries: %+v", summaries)
+	}
+	lines := readTimerLog(t, logfile)
+	if len(lines) != 1 || !strings.Contains(lines[0], `"outcome":"timeout"`) {
+		t.Errorf("Wrong log: %v", lines)
+	}
+}
+
+func TestTimerSummarizesTagTemplates(t *testing.T) {
+	StartWorkers(10)
+	defer StopAllWorkers()
+
+	taskSpec := genSingleActionTask()
+	taskSpec.ConcurrentActions[0].Actions[0].Tag = "ping-{{randInt 1 1000000}}"
+	taskSpec.Load = &LoadSpec{
+		Rate:            1000,
+		Duration:        "10s",
+		MaxNrIterations: 20,
+	}
+	rr, logfile := newTestTimer(t, nil, &statusResponseReader{status: 200})
+	runTask(t, taskSpec, rr)
+	summaries := rr.(LatencySummarizer).LatencySummaries()
+	rr.Close()
+
+	if len(summaries) != 1 || summaries[0].Tag != "ping-{{randInt 1 1000000}}" || summaries[0].Count != 20 {
+		t.Errorf("Wrong summaries: %+v", summaries)
+	}
+	tags := make(map[string]bool, 20)
+	for _, line := range readTimerLog(t, logfile) {
+		tags[strings.Split(line, "\t")[1]] = true
+	}
+	if len(tags) < 2 {
+		t.Errorf("The log should have the executed tags: %v", tags)
+	}
+}